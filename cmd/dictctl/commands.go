@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/beppeben/go-dictionary/excel"
+	"github.com/beppeben/go-dictionary/persistence"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+func validateCmd(args []string) error {
+	fs := newFlagSet("validate")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	problems := persistence.ValidateWorkbook(excel.NewReader(fs.Arg(0)))
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in %s", len(problems), fs.Arg(0))
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+func importCmd(args []string) error {
+	fs := newFlagSet("import")
+	configDir := fs.String("config", "./config/", "directory containing config.toml")
+	calendar := fs.Bool("calendar", false, "import a calendar workbook instead of the dictionary")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	file := fs.Arg(0)
+	config := utils.NewConfig(*configDir)
+	if *calendar {
+		repo, err := openRepo(config, excel.NewReader(config.GetExcelDir()+"mydb.xlsx"), excel.NewReader(file))
+		if err != nil {
+			return err
+		}
+		counts, err := repo.ResetCalendar(context.Background())
+		if err != nil {
+			return err
+		}
+		printCounts(counts)
+		return nil
+	}
+	if problems := persistence.ValidateWorkbook(excel.NewReader(file)); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		return fmt.Errorf("refusing to import an invalid workbook")
+	}
+	repo, err := openRepo(config, excel.NewReader(file), excel.NewReader(config.GetExcelDir()+"calendar.xlsx"))
+	if err != nil {
+		return err
+	}
+	counts, err := repo.ResetDB(context.Background())
+	if err != nil {
+		return err
+	}
+	printCounts(counts)
+	return nil
+}
+
+func printCounts(counts map[string]int) {
+	tables := make([]string, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("%s\t%d rows\n", table, counts[table])
+	}
+	fmt.Println("OK")
+}
+
+func exportCmd(args []string) error {
+	fs := newFlagSet("export")
+	configDir := fs.String("config", "./config/", "directory containing config.toml")
+	tables := fs.String("tables", "", "comma separated list of tables (default: all dictionary tables)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	out := fs.Arg(0)
+	config := utils.NewConfig(*configDir)
+	repo, err := openRepo(config, excel.NewReader(config.GetExcelDir()+"mydb.xlsx"),
+		excel.NewReader(config.GetExcelDir()+"calendar.xlsx"))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	titles := repo.GetTableNames(ctx)
+	if *tables != "" {
+		titles = strings.Split(*tables, ",")
+	}
+
+	if filepath.Ext(out) == ".csv" {
+		if len(titles) != 1 {
+			return fmt.Errorf("csv export needs exactly one table, got %d", len(titles))
+		}
+		matrix, err := repo.GetTableMatrix(ctx, titles[0])
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := csv.NewWriter(f)
+		w.WriteAll(matrix)
+		return w.Error()
+	}
+
+	writer := excel.NewWriter()
+	for _, title := range titles {
+		matrix, err := repo.GetTableMatrix(ctx, title)
+		if err != nil {
+			return err
+		}
+		if err = writer.AddMatrix(title, matrix); err != nil {
+			return err
+		}
+	}
+	return writer.Save(out)
+}
+
+func searchCmd(args []string) error {
+	fs := newFlagSet("search")
+	configDir := fs.String("config", "./config/", "directory containing config.toml")
+	base := fs.String("base", "eng", "language key used for field and language names")
+	fs.Parse(args)
+	if fs.NArg() != 2 || len(fs.Arg(0)) != 6 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	config := utils.NewConfig(*configDir)
+	repo, err := openRepo(config, excel.NewReader(config.GetExcelDir()+"mydb.xlsx"),
+		excel.NewReader(config.GetExcelDir()+"calendar.xlsx"))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	key := fs.Arg(0)
+	fromLang := repo.GetLangFromKey(ctx, key[:3])
+	toLang := repo.GetLangFromKey(ctx, key[3:])
+	baseLang := repo.GetLangFromKey(ctx, *base)
+	if fromLang == "" || toLang == "" || baseLang == "" {
+		return fmt.Errorf("invalid language keys %s/%s", key, *base)
+	}
+	words, err := repo.Search(ctx, fs.Arg(1), fromLang, toLang, baseLang)
+	if err != nil {
+		return err
+	}
+	for _, word := range words {
+		fmt.Printf("%s (%s)", word.Word, word.Lang.Language)
+		if word.Field != "" {
+			fmt.Printf(" [%s]", word.Field)
+		}
+		if word.Description != "" {
+			fmt.Printf(" - %s", word.Description)
+		}
+		fmt.Println()
+		for _, tran := range word.Translations {
+			fmt.Printf("\t%s\n", tran.Word)
+		}
+		if len(word.Synonyms) > 0 {
+			syns := make([]string, len(word.Synonyms))
+			for i, syn := range word.Synonyms {
+				syns[i] = syn.Word
+			}
+			fmt.Printf("\tsynonyms: %s\n", strings.Join(syns, ", "))
+		}
+	}
+	return nil
+}
+
+func openRepo(config *utils.AppConfig, dbReader, calReader *excel.ExcelReader) (*persistence.SqlRepo, error) {
+	handler, err := persistence.NewMySqlHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	return persistence.NewRepo(handler, dbReader, calReader)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var deployEndpoints = map[string]string{
+	"db":    "/services/deployDb",
+	"front": "/services/deployFront",
+	"cal":   "/services/deployCal",
+}
+
+func deployCmd(args []string) error {
+	fs := newFlagSet("deploy")
+	url := fs.String("url", "", "base url of the remote server, e.g. https://example.com")
+	user := fs.String("user", "admin", "admin username")
+	pass := fs.String("pass", os.Getenv("DICTCTL_PASS"), "admin password (default $DICTCTL_PASS)")
+	token := fs.String("token", os.Getenv("DICTCTL_TOKEN"), "API token, used instead of -user and -pass (default $DICTCTL_TOKEN)")
+	mode := fs.String("mode", "", "how the events of an .ics calendar are imported: merge (default) or replace")
+	fs.Parse(args)
+	if fs.NArg() != 2 || *url == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	endpoint, ok := deployEndpoints[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown bundle kind %q", fs.Arg(0))
+	}
+
+	fields := make(map[string]string)
+	if *mode != "" {
+		fields["mode"] = *mode
+	}
+	body, contentType, err := multipartBundle(fs.Arg(1), fields)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(*url, "/")+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	} else {
+		req.SetBasicAuth(*user, *pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(reply) != "OK" {
+		return fmt.Errorf("server replied %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// multipartBundle wraps a file in the "bundle" form field expected by the
+// deploy endpoints, along with the other fields.
+func multipartBundle(path string, fields map[string]string) (io.Reader, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	buffer := new(bytes.Buffer)
+	w := multipart.NewWriter(buffer)
+	for name, value := range fields {
+		if err = w.WriteField(name, value); err != nil {
+			return nil, "", err
+		}
+	}
+	part, err := w.CreateFormFile("bundle", filepath.Base(path))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = io.Copy(part, f); err != nil {
+		return nil, "", err
+	}
+	if err = w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buffer, w.FormDataContentType(), nil
+}
@@ -0,0 +1,71 @@
+// Command dictctl manages a dictionary database without going through the
+// web server: it validates and imports workbooks, exports tables, runs
+// searches and pushes bundles to a remote server's deploy endpoints.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var commands = map[string]func(args []string) error{
+	"validate": validateCmd,
+	"import":   importCmd,
+	"export":   exportCmd,
+	"search":   searchCmd,
+	"deploy":   deployCmd,
+	"user":     userCmd,
+}
+
+var usages = map[string]string{
+	"validate": "validate <workbook.xlsx>",
+	"import":   "import [-config dir] [-calendar] <workbook.xlsx>",
+	"export":   "export [-config dir] [-tables t1,t2] <out.xlsx|out.csv>",
+	"search":   "search [-config dir] [-base lang] <fromto> <word>",
+	"deploy":   "deploy -url url (-pass password [-user admin] | -token token) [-mode merge|replace] <db|front|cal> <file>",
+	"user":     "user [-config dir] [-role role] <list|add|passwd|role|remove> [username]",
+}
+
+func main() {
+	log.SetLevel(log.WarnLevel)
+	log.SetFormatter(&log.TextFormatter{DisableColors: true})
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "dictctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  dictctl "+usages[name])
+	}
+	os.Exit(2)
+}
+
+// newFlagSet returns a flag set whose usage message matches the command's.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dictctl "+usages[name])
+		fs.PrintDefaults()
+	}
+	return fs
+}
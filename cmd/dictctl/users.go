@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/excel"
+	"github.com/beppeben/go-dictionary/persistence"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+func userCmd(args []string) error {
+	fs := newFlagSet("user")
+	configDir := fs.String("config", "./config/", "directory containing config.toml")
+	role := fs.String("role", "", "role of the user: viewer, editor or admin")
+	fs.Parse(args)
+	if fs.NArg() < 1 || (fs.Arg(0) != "list" && fs.NArg() != 2) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	config := utils.NewConfig(*configDir)
+	repo, err := openRepo(config, excel.NewReader(config.GetExcelDir()+"mydb.xlsx"),
+		excel.NewReader(config.GetExcelDir()+"calendar.xlsx"))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	username := fs.Arg(1)
+
+	switch fs.Arg(0) {
+	case "list":
+		users, err := repo.ListUsers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Printf("%s\t%s\t%s\n", user.Username, user.Role, user.Created.Format("2006-01-02"))
+		}
+	case "add":
+		if *role == "" {
+			return fmt.Errorf("-role is required")
+		}
+		userRole, err := ParseRole(*role)
+		if err != nil {
+			return err
+		}
+		hash, err := readPasswordHash()
+		if err != nil {
+			return err
+		}
+		err = repo.CreateUser(ctx, &AdminUser{Username: username, PasswordHash: hash, Role: userRole})
+		if err != nil {
+			return err
+		}
+	case "passwd", "role":
+		user, err := findUser(ctx, repo, username)
+		if err != nil {
+			return err
+		}
+		if fs.Arg(0) == "passwd" {
+			user.PasswordHash, err = readPasswordHash()
+		} else {
+			user.Role, err = ParseRole(*role)
+		}
+		if err != nil {
+			return err
+		}
+		if err = repo.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+	case "remove":
+		if err = repo.DeleteUser(ctx, username); err != nil {
+			return err
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+func findUser(ctx context.Context, repo *persistence.SqlRepo, username string) (*AdminUser, error) {
+	user, err := repo.GetUser(ctx, username)
+	if err == nil && user == nil {
+		err = fmt.Errorf("no such user %s", username)
+	}
+	return user, err
+}
+
+// readPasswordHash reads a password from the first line of standard input,
+// so that it does not end up in the shell history.
+func readPasswordHash() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 8 {
+		return "", fmt.Errorf("password must be at least 8 characters long")
+	}
+	return utils.HashPassword(password)
+}
@@ -0,0 +1,36 @@
+package domain
+
+import (
+	"time"
+)
+
+const (
+	AuditOK     = "ok"
+	AuditError  = "error"
+	AuditDenied = "denied"
+)
+
+// AuditRecord describes a call to an administrative endpoint.
+type AuditRecord struct {
+	Id       int64
+	Time     time.Time
+	Actor    string
+	Ip       string
+	Action   string
+	FileHash string
+	FileSize int64
+	Outcome  string
+	Error    string
+	// rows imported per table, for database and calendar deploys
+	RowCounts map[string]int
+}
+
+// AuditFilter selects audit records. Zero fields match everything.
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Outcome string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
@@ -1,10 +1,14 @@
 package domain
 
 import (
+	"errors"
 	"strings"
 	"time"
 )
 
+// ErrRateLimited is returned when a client made too many requests of a kind.
+var ErrRateLimited = errors.New("too many requests")
+
 type CalendarEvent struct {
 	Id          int64
 	StartDate   time.Time
@@ -12,10 +16,37 @@ type CalendarEvent struct {
 	Tag         string
 	Title       string
 	Description string
+	// UID identifies events imported from iCalendar files
+	UID string
+	// Recurrence is an optional RRULE value, e.g. FREQ=YEARLY;BYMONTH=3,
+	// repeating the event from its start date, except on the Exceptions
+	Recurrence string
+	Exceptions []time.Time
+}
+
+// CalendarFilter selects the events overlapping the days From to To, both
+// included. Tag and Query match everything when empty; Query is searched in
+// titles and descriptions.
+type CalendarFilter struct {
+	From  time.Time
+	To    time.Time
+	Tag   string
+	Query string
+}
+
+// DictionaryStatus describes the state of the dictionary database and caches.
+type DictionaryStatus struct {
+	Ready      bool
+	Importing  bool
+	Version    string
+	LastImport time.Time
+	Languages  int
 }
 
 type Word struct {
 	//LangKey      string
+	// id of the concept, i.e. of the english entry the word translates
+	Id           int64
 	Word         string
 	Lang         *Language
 	Field        string
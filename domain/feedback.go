@@ -0,0 +1,22 @@
+package domain
+
+import (
+	"time"
+)
+
+// FeedbackCategories are the kinds of problems users can report on an entry.
+var FeedbackCategories = []string{"wrong-translation", "wrong-genre", "typo", "other"}
+
+// Feedback is a problem reported by a user on the word of concept ConceptId
+// in language Lang.
+type Feedback struct {
+	Id        int64
+	ConceptId int64
+	Lang      string
+	Word      string
+	Category  string
+	Comment   string
+	Ip        string `json:"-"`
+	Created   time.Time
+	Resolved  bool
+}
@@ -0,0 +1,21 @@
+package domain
+
+import (
+	"time"
+)
+
+// Notification is a message waiting to be delivered on a channel.
+type Notification struct {
+	Id             int64
+	Event          string
+	Channel        string
+	Subject        string
+	Body           string
+	Format         string // text, slack or html
+	AttachmentName string
+	Attachment     string
+	Attempts       int
+	NextAttempt    time.Time
+	LastError      string
+	Created        time.Time
+}
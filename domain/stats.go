@@ -0,0 +1,39 @@
+package domain
+
+import (
+	"time"
+)
+
+// SearchStat counts the searches of a term in a dictionary on a day.
+// Day is zero when the stat is aggregated over a range of days.
+type SearchStat struct {
+	Day      time.Time
+	LangPair string
+	Term     string
+	Found    bool
+	Hits     int
+}
+
+// VisitStat counts the requests of a visitor, identified by a hash of their
+// address and user agent, on a day.
+type VisitStat struct {
+	Day       time.Time
+	Visitor   string
+	Ip        string
+	City      string
+	Region    string
+	Country   string
+	UserAgent string
+	Referer   string
+	LastUri   string
+	Hits      int
+}
+
+// CounterStat counts the occurrences of Key in the counter Name on a day,
+// e.g. the requests with base language "ita" in "base_lang".
+type CounterStat struct {
+	Day  time.Time
+	Name string
+	Key  string
+	Hits int
+}
@@ -0,0 +1,24 @@
+package domain
+
+import (
+	"time"
+)
+
+const (
+	SuggestionPending  = "pending"
+	SuggestionAdded    = "added"
+	SuggestionRejected = "rejected"
+)
+
+// Suggestion is a word users searched for and asked to be added to the
+// dictionary of FromLang to ToLang.
+type Suggestion struct {
+	Id        int64
+	Word      string
+	FromLang  string
+	ToLang    string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Status    string
+}
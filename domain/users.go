@@ -0,0 +1,109 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+type Permission string
+
+const (
+	PermReadStats   Permission = "read-stats"
+	PermEditEntries Permission = "edit-entries"
+	PermEditWeb     Permission = "edit-web"
+	PermDeployFront Permission = "deploy-front"
+	PermDeployDb    Permission = "deploy-db"
+	PermDeployCal   Permission = "deploy-cal"
+	PermReadAudit   Permission = "read-audit"
+	// tokens can never be granted this one, so a leaked token cannot mint others
+	PermManageTokens Permission = "manage-tokens"
+)
+
+// each role includes the permissions of the roles below it
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {PermReadStats},
+	RoleEditor: {PermReadStats, PermEditEntries, PermEditWeb},
+	RoleAdmin: {PermReadStats, PermEditEntries, PermEditWeb, PermDeployFront, PermDeployDb, PermDeployCal,
+		PermReadAudit, PermManageTokens},
+}
+
+// TokenPermissions are the permissions that can be granted to API tokens.
+var TokenPermissions = []Permission{PermDeployFront, PermDeployDb, PermDeployCal, PermReadStats}
+
+func ParseTokenPermission(s string) (Permission, error) {
+	for _, p := range TokenPermissions {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown token permission %q (expected deploy-front, deploy-db, deploy-cal or read-stats)", s)
+}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", fmt.Errorf("Unknown role %q (expected viewer, editor or admin)", s)
+	}
+	return role, nil
+}
+
+func (role Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+type AdminUser struct {
+	Username     string
+	PasswordHash string
+	Role         Role
+	Created      time.Time
+}
+
+// ApiToken is a bearer token for scripts. Only the sha256 hash of the
+// token is stored.
+type ApiToken struct {
+	Id          int64
+	Name        string
+	Permissions []Permission
+	Expires     time.Time
+	CreatedBy   string
+	Created     time.Time
+	Revoked     bool
+}
+
+func (t *ApiToken) Valid(now time.Time) bool {
+	return !t.Revoked && now.Before(t.Expires)
+}
+
+// Principal is the identity an administrative request was authenticated as.
+// Requests authenticated with a token carry the token permissions instead
+// of a role.
+type Principal struct {
+	Name        string
+	Role        Role
+	Permissions []Permission
+}
+
+func (p *Principal) Can(perm Permission) bool {
+	if p.Permissions != nil {
+		for _, granted := range p.Permissions {
+			if granted == perm {
+				return true
+			}
+		}
+		return false
+	}
+	return p.Role.Can(perm)
+}
@@ -1,7 +1,10 @@
 package excel
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
 	"strings"
 
 	"github.com/tealeg/xlsx"
@@ -30,6 +33,17 @@ func (e *ExcelReader) RefreshFile() error {
 	return nil
 }
 
+// Checksum returns a short hex digest of the file contents, used to tell
+// which version of a workbook was imported.
+func (e *ExcelReader) Checksum() (string, error) {
+	data, err := ioutil.ReadFile(e.xlFilePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12], nil
+}
+
 func (e *ExcelReader) GetSheet(name string) (*xlsx.Sheet, error) {
 	for _, sheet := range e.xlFile.Sheets {
 		if sheet.Name == name {
@@ -0,0 +1,38 @@
+package excel
+
+import (
+	"io"
+
+	"github.com/tealeg/xlsx"
+)
+
+type ExcelWriter struct {
+	xlFile *xlsx.File
+}
+
+func NewWriter() *ExcelWriter {
+	return &ExcelWriter{xlFile: xlsx.NewFile()}
+}
+
+// AddMatrix appends a sheet named title, writing one row per matrix line.
+func (e *ExcelWriter) AddMatrix(title string, matrix [][]string) error {
+	sheet, err := e.xlFile.AddSheet(title)
+	if err != nil {
+		return err
+	}
+	for _, line := range matrix {
+		row := sheet.AddRow()
+		for _, value := range line {
+			row.AddCell().SetString(value)
+		}
+	}
+	return nil
+}
+
+func (e *ExcelWriter) Save(path string) error {
+	return e.xlFile.Save(path)
+}
+
+func (e *ExcelWriter) Write(w io.Writer) error {
+	return e.xlFile.Write(w)
+}
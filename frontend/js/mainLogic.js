@@ -16,12 +16,32 @@ jQuery(function($) {
 });
 
 $("#notfoundSend").click(function() {
-	var url = "/services/notify?word=" + $('#search-text').val() + "&langkey=" + $('#select').val();
-	$.get(url);
+	$.post("/services/notify", {word: $('#search-text').val(), langkey: $('#select').val()});
 	$("#thanks").show();
 	$('#notfoundText').hide();
 });
 
+var feedbackEntry = null;
+
+$(".report").click(function() {
+	feedbackEntry = $(this).data();
+	$('#feedbackWord').text(feedbackEntry.word);
+	$('#feedbackComment').val('');
+	$('#feedbackThanks').hide();
+	$('#feedbackForm').show();
+});
+
+$("#feedbackSend").click(function() {
+	if (feedbackEntry == null) {
+		return;
+	}
+	$.post("/services/feedback", {lang: feedbackEntry.lang, id: feedbackEntry.id, word: feedbackEntry.word,
+		category: $('#feedbackCategory').val(), comment: $('#feedbackComment').val()});
+	feedbackEntry = null;
+	$('#feedbackForm').hide();
+	$('#feedbackThanks').show();
+});
+
 $('#search-text').keyup( function(e) {
 	if (this.value.length <= 1){
 		$('#notfoundText').hide();
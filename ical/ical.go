@@ -0,0 +1,144 @@
+// Package ical reads and writes iCalendar (RFC 5545) files of all-day events.
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	dateFormat     = "20060102"
+	dateTimeFormat = "20060102T150405Z"
+	// lines longer than this are folded, as the RFC requires
+	maxLineOctets = 75
+)
+
+// Event is an all-day event. End is the last day of the event, not the day
+// after as in iCalendar.
+type Event struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	Categories  []string
+	URL         string
+	// Recurrence is an RRULE value, see Rule, and Exceptions the days
+	// removed from it
+	Recurrence string
+	Exceptions []time.Time
+}
+
+// Calendar is a named list of events.
+type Calendar struct {
+	ProdID string
+	Name   string
+	// RefreshInterval tells subscribers how often to poll the feed
+	RefreshInterval time.Duration
+	Events          []*Event
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// escapeText escapes a TEXT value.
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// formatDuration returns d in hours and minutes, e.g. PT1H30M.
+func formatDuration(d time.Duration) string {
+	s := "PT"
+	if h := int(d.Hours()); h > 0 {
+		s += strconv.Itoa(h) + "H"
+	}
+	if m := int(d.Minutes()) % 60; m > 0 || s == "PT" {
+		s += strconv.Itoa(m) + "M"
+	}
+	return s
+}
+
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes a content line, folding it into lines of at most 75 octets
+// without splitting UTF-8 sequences.
+func (w *writer) line(name, value string) {
+	if w.err != nil {
+		return
+	}
+	s := name + ":" + value
+	limit := maxLineOctets
+	for len(s) > limit {
+		cut := limit
+		for !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		// the leading space of continuation lines counts
+		limit = maxLineOctets - 1
+	}
+	_, w.err = w.w.WriteString(s + "\r\n")
+}
+
+// Encode writes the calendar to out.
+func (c *Calendar) Encode(out io.Writer) error {
+	w := &writer{w: bufio.NewWriter(out)}
+	stamp := time.Now().UTC().Format(dateTimeFormat)
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", escapeText(c.ProdID))
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		w.line("X-WR-CALNAME", escapeText(c.Name))
+	}
+	if c.RefreshInterval > 0 {
+		w.line("REFRESH-INTERVAL;VALUE=DURATION", formatDuration(c.RefreshInterval))
+		w.line("X-PUBLISHED-TTL", formatDuration(c.RefreshInterval))
+	}
+	for _, e := range c.Events {
+		w.line("BEGIN", "VEVENT")
+		w.line("UID", e.UID)
+		w.line("DTSTAMP", stamp)
+		w.line("DTSTART;VALUE=DATE", e.Start.Format(dateFormat))
+		w.line("DTEND;VALUE=DATE", e.End.AddDate(0, 0, 1).Format(dateFormat))
+		w.line("SUMMARY", escapeText(e.Summary))
+		if e.Description != "" {
+			w.line("DESCRIPTION", escapeText(e.Description))
+		}
+		if len(e.Categories) > 0 {
+			categories := make([]string, len(e.Categories))
+			for i, category := range e.Categories {
+				categories[i] = escapeText(category)
+			}
+			w.line("CATEGORIES", strings.Join(categories, ","))
+		}
+		if e.URL != "" {
+			w.line("URL", e.URL)
+		}
+		if e.Recurrence != "" {
+			w.line("RRULE", e.Recurrence)
+			if len(e.Exceptions) > 0 {
+				days := make([]string, len(e.Exceptions))
+				for i, d := range e.Exceptions {
+					days[i] = d.Format(dateFormat)
+				}
+				w.line("EXDATE;VALUE=DATE", strings.Join(days, ","))
+			}
+		}
+		w.line("TRANSP", "TRANSPARENT")
+		w.line("END", "VEVENT")
+	}
+	w.line("END", "VCALENDAR")
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,158 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	calendar := &Calendar{ProdID: "-//Test//EN", Name: "Fairs", RefreshInterval: 12 * time.Hour, Events: []*Event{{
+		UID:         "event-1@example.com",
+		Start:       day("2026-03-26"),
+		End:         day("2026-03-31"),
+		Summary:     "Watches, Jewels; Baselworld",
+		Description: strings.Repeat("é", 60) + "\nsecond line",
+		Categories:  []string{"fair"},
+	}}}
+	var buff bytes.Buffer
+	if err := calendar.Encode(&buff); err != nil {
+		t.Fatal(err)
+	}
+	out := buff.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:Fairs\r\n",
+		"REFRESH-INTERVAL;VALUE=DURATION:PT12H\r\n",
+		"DTSTART;VALUE=DATE:20260326\r\n",
+		// DTEND is exclusive
+		"DTEND;VALUE=DATE:20260401\r\n",
+		`SUMMARY:Watches\, Jewels\; Baselworld` + "\r\n",
+		"CATEGORIES:fair\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	for _, line := range strings.Split(out, "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("line not folded: %q", line)
+		}
+	}
+	unfolded := strings.Replace(out, "\r\n ", "", -1)
+	if !strings.Contains(unfolded, "DESCRIPTION:"+strings.Repeat("é", 60)+`\nsecond line`) {
+		t.Errorf("description not folded back:\n%s", unfolded)
+	}
+}
+
+func TestParse(t *testing.T) {
+	file := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nUID:fair-1@example.com\r\nDTSTART;VALUE=DATE:20260326\r\nDTEND;VALUE=DATE:20260401\r\n" +
+		"SUMMARY:Watches\\, Jewels\r\nDESCRIPTION:First line\\nsecond \r\n line\r\nCATEGORIES:fair,Basel\r\n" +
+		"BEGIN:VALARM\r\nACTION:DISPLAY\r\nDESCRIPTION:Reminder\r\nEND:VALARM\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:talk@example.com\r\nDTSTART;TZID=\"Europe/Rome\":20260410T180000\r\n" +
+		"DURATION:PT6H\r\nSUMMARY:Evening talk\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:gone@example.com\r\nDTSTART:20260412T090000Z\r\nSTATUS:CANCELLED\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	events, err := Parse(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	fair := events[0]
+	if fair.UID != "fair-1@example.com" || fair.Summary != "Watches, Jewels" ||
+		fair.Description != "First line\nsecond line" || strings.Join(fair.Categories, "|") != "fair|Basel" {
+		t.Errorf("unexpected event %+v", fair)
+	}
+	if fair.Start.Format("2006-01-02") != "2026-03-26" || fair.End.Format("2006-01-02") != "2026-03-31" {
+		t.Errorf("fair lasts from %v to %v", fair.Start, fair.End)
+	}
+	// ends at midnight, so the day after is not included
+	talk := events[1]
+	if talk.Start.Format("2006-01-02") != "2026-04-10" || talk.End.Format("2006-01-02") != "2026-04-10" {
+		t.Errorf("talk lasts from %v to %v", talk.Start, talk.End)
+	}
+
+	if _, err := Parse(strings.NewReader("BEGIN:VEVENT\r\nSUMMARY:No start\r\nEND:VEVENT\r\n")); err == nil {
+		t.Error("event without start accepted")
+	}
+	backwards := "BEGIN:VEVENT\r\nSUMMARY:Backwards\r\nDTSTART;VALUE=DATE:20260401\r\nDTEND;VALUE=DATE:20260326\r\nEND:VEVENT\r\n"
+	if _, err := Parse(strings.NewReader(backwards)); err == nil {
+		t.Error("event ending before its start accepted")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	format := func(days []time.Time) string {
+		s := make([]string, len(days))
+		for i, d := range days {
+			s[i] = d.Format("2006-01-02")
+		}
+		return strings.Join(s, " ")
+	}
+	for _, c := range []struct {
+		rule       string
+		start, end string
+		from, to   string
+		exceptions []time.Time
+		want       string
+	}{
+		// a fair on the last Thursday of March, lasting into April
+		{"FREQ=YEARLY;BYMONTH=3;BYDAY=-1TH", "2026-03-26", "2026-04-01", "2027-03-31", "2028-03-31", nil,
+			"2027-03-25 2028-03-30"},
+		{"FREQ=WEEKLY;BYDAY=TU,TH", "2026-10-06", "2026-10-06", "2026-10-12", "2026-10-25",
+			[]time.Time{day("2026-10-15")}, "2026-10-13 2026-10-20 2026-10-22"},
+		// months without a 31st are skipped
+		{"FREQ=MONTHLY", "2026-01-31", "2026-01-31", "2026-01-01", "2026-06-30", nil,
+			"2026-01-31 2026-03-31 2026-05-31"},
+		{"FREQ=MONTHLY;INTERVAL=2;COUNT=3", "2026-01-10", "2026-01-10", "2026-01-01", "2026-12-31", nil,
+			"2026-01-10 2026-03-10 2026-05-10"},
+		{"FREQ=DAILY;UNTIL=20261003", "2026-10-01", "2026-10-01", "2026-09-01", "2026-10-31", nil,
+			"2026-10-01 2026-10-02 2026-10-03"},
+		// old rules are expanded well past maxPeriods days from their start
+		{"FREQ=DAILY;INTERVAL=2", "1950-01-01", "1950-01-01", "2026-10-01", "2026-10-05", nil,
+			"2026-10-01 2026-10-03 2026-10-05"},
+		{"FREQ=WEEKLY;BYDAY=SU", "1970-01-04", "1970-01-05", "2026-10-19", "2026-10-26", nil,
+			"2026-10-18 2026-10-25"},
+		// BYDAY narrows BYMONTHDAY down
+		{"FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13", "2026-02-13", "2026-02-13", "2026-01-01", "2027-12-31", nil,
+			"2026-02-13 2026-03-13 2026-11-13 2027-08-13"},
+		// without months, yearly days are taken from every month
+		{"FREQ=YEARLY;BYMONTHDAY=1", "2026-01-01", "2026-01-01", "2026-01-01", "2026-04-30", nil,
+			"2026-01-01 2026-02-01 2026-03-01 2026-04-01"},
+		{"FREQ=MONTHLY;BYMONTHDAY=15", "1000-01-15", "1000-01-16", "2026-10-16", "2026-11-30", nil,
+			"2026-10-15 2026-11-15"},
+		{"FREQ=YEARLY;INTERVAL=3", "1001-03-01", "1001-03-01", "2026-01-01", "2030-12-31", nil,
+			"2027-03-01 2030-03-01"},
+		// counted rules are expanded from their start
+		{"FREQ=DAILY;COUNT=3", "1900-01-01", "1900-01-01", "2026-01-01", "2026-12-31", nil, ""},
+	} {
+		rule, err := ParseRule(c.rule)
+		if err != nil {
+			t.Errorf("%s: %v", c.rule, err)
+			continue
+		}
+		got := format(rule.Expand(day(c.start), day(c.end), day(c.from), day(c.to), c.exceptions))
+		if got != c.want {
+			t.Errorf("%s from %s to %s: got %q, expected %q", c.rule, c.from, c.to, got, c.want)
+		}
+	}
+
+	for _, invalid := range []string{"FREQ=HOURLY", "BYMONTH=3", "FREQ=WEEKLY;BYDAY=1MO", "FREQ=YEARLY;BYDAY=1MO", "FREQ=DAILY;BYSETPOS=1"} {
+		if _, err := ParseRule(invalid); err == nil {
+			t.Errorf("%s accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineLength bounds the unfolded content lines, descriptions included.
+const maxLineLength = 1 << 20
+
+// property is a content line, e.g. DTSTART;VALUE=DATE:20260326.
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Parse reads the events of an iCalendar file. Events are reduced to the
+// days they cover, as written in their own time zone, and cancelled ones
+// are skipped.
+func Parse(in io.Reader) ([]*Event, error) {
+	lines, err := unfold(in)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0)
+	var event *Event
+	var start, end *property
+	var duration string
+	var cancelled bool
+	// components nested in events, like alarms, are skipped
+	nested := 0
+	for n, line := range lines {
+		if line == "" {
+			continue
+		}
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		switch {
+		case p.name == "BEGIN" && strings.ToUpper(p.value) == "VEVENT":
+			event, start, end, duration, cancelled = &Event{}, nil, nil, "", false
+		case event == nil:
+		case p.name == "BEGIN":
+			nested++
+		case p.name == "END" && nested > 0:
+			nested--
+		case nested > 0:
+		case p.name == "END" && strings.ToUpper(p.value) == "VEVENT":
+			if start == nil {
+				return nil, fmt.Errorf("line %d: event %q has no start", n+1, event.Summary)
+			}
+			if err = setDays(event, start, end, duration); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			if !cancelled {
+				events = append(events, event)
+			}
+			event = nil
+		case p.name == "UID":
+			event.UID = p.value
+		case p.name == "DTSTART":
+			start = p
+		case p.name == "DTEND":
+			end = p
+		case p.name == "DURATION":
+			duration = p.value
+		case p.name == "SUMMARY":
+			event.Summary = unescapeText(p.value)
+		case p.name == "DESCRIPTION":
+			event.Description = unescapeText(p.value)
+		case p.name == "CATEGORIES":
+			for _, category := range splitEscaped(p.value, ',') {
+				if category = strings.TrimSpace(unescapeText(category)); category != "" {
+					event.Categories = append(event.Categories, category)
+				}
+			}
+		case p.name == "URL":
+			event.URL = p.value
+		case p.name == "RRULE":
+			if _, err = ParseRule(p.value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			event.Recurrence = p.value
+		case p.name == "EXDATE":
+			for _, value := range strings.Split(p.value, ",") {
+				d, _, err := parseDay(&property{params: p.params, value: value})
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid exception %q", n+1, value)
+				}
+				event.Exceptions = append(event.Exceptions, day(d))
+			}
+		case p.name == "STATUS":
+			cancelled = strings.ToUpper(p.value) == "CANCELLED"
+		}
+	}
+	if event != nil {
+		return nil, fmt.Errorf("event %q is not terminated", event.Summary)
+	}
+	return events, nil
+}
+
+// unfold returns the content lines, joining the folded ones.
+func unfold(in io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseProperty splits a content line into name, parameters and value.
+// Parameter values may be quoted, and contain ':' and ';' then.
+func parseProperty(line string) (*property, error) {
+	p := &property{params: make(map[string]string)}
+	quoted := false
+	fields := make([]string, 0, 2)
+	last := 0
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ';':
+			fields = append(fields, line[last:i])
+			last = i + 1
+		case c == ':':
+			fields = append(fields, line[last:i])
+			p.name = strings.ToUpper(fields[0])
+			for _, param := range fields[1:] {
+				kv := strings.SplitN(param, "=", 2)
+				if len(kv) == 2 {
+					p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+				}
+			}
+			p.value = line[i+1:]
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid content line %q", line)
+}
+
+var textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+func unescapeText(s string) string {
+	return textUnescaper.Replace(s)
+}
+
+// splitEscaped splits s on the separators that are not escaped.
+func splitEscaped(s string, sep byte) []string {
+	parts := make([]string, 0, 1)
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(parts, s[last:])
+}
+
+// parseDay returns a DATE or DATE-TIME value, and whether it had a time.
+func parseDay(p *property) (time.Time, bool, error) {
+	value := p.value
+	if p.params["VALUE"] == "DATE" || len(value) == len(dateFormat) {
+		day, err := time.Parse(dateFormat, value)
+		return day, false, err
+	}
+	t, err := time.Parse("20060102T150405", strings.TrimSuffix(value, "Z"))
+	return t, true, err
+}
+
+// setDays sets the first and last day of event. An end at midnight
+// excludes that day, as does an end date.
+func setDays(event *Event, start, end *property, duration string) error {
+	begin, hasTime, err := parseDay(start)
+	if err != nil {
+		return fmt.Errorf("invalid start of %q: %v", event.Summary, err)
+	}
+	finish := begin
+	switch {
+	case end != nil:
+		if finish, _, err = parseDay(end); err != nil {
+			return fmt.Errorf("invalid end of %q: %v", event.Summary, err)
+		}
+	case duration != "":
+		d, err := parseDuration(duration)
+		if err != nil {
+			return fmt.Errorf("invalid duration of %q: %v", event.Summary, err)
+		}
+		finish = d.add(begin)
+	case !hasTime:
+		// a date without end lasts one day
+		finish = begin.AddDate(0, 0, 1)
+	}
+	if finish.Before(begin) {
+		return fmt.Errorf("end of %q is before its start", event.Summary)
+	}
+	if finish.After(begin) {
+		finish = finish.Add(-time.Nanosecond)
+	}
+	y, m, d := begin.Date()
+	event.Start = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	y, m, d = finish.Date()
+	event.End = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return nil
+}
+
+// duration is a DURATION value: days are kept apart from the time, as they
+// follow the calendar.
+type duration struct {
+	days int
+	time time.Duration
+}
+
+func (d duration) add(t time.Time) time.Time {
+	return t.AddDate(0, 0, d.days).Add(d.time)
+}
+
+// parseDuration parses a positive duration, e.g. P1W or P2DT12H.
+func parseDuration(s string) (d duration, err error) {
+	s = strings.TrimPrefix(s, "+")
+	if !strings.HasPrefix(s, "P") {
+		return d, fmt.Errorf("invalid duration %q", s)
+	}
+	inTime := false
+	number := ""
+	for _, c := range s[1:] {
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return d, fmt.Errorf("invalid duration %q", s)
+		}
+		number = ""
+		switch {
+		case c == 'W' && !inTime:
+			d.days += 7 * n
+		case c == 'D' && !inTime:
+			d.days += n
+		case c == 'H' && inTime:
+			d.time += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d.time += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d.time += time.Duration(n) * time.Second
+		default:
+			return d, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if number != "" {
+		return d, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
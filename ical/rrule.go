@@ -0,0 +1,341 @@
+package ical
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPeriods bounds the number of periods an expansion goes through. It
+// stops rules that never match, e.g. the 31st of February, and counted rules,
+// which are expanded from their start, are only expanded over that many
+// periods.
+const maxPeriods = 10000
+
+var ruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// weekdayRule is a BYDAY value: a weekday, with an ordinal within the month
+// (1 for the first, -1 for the last) or 0 for all of them.
+type weekdayRule struct {
+	ordinal int
+	weekday time.Weekday
+}
+
+// Rule is a recurrence rule (RRULE) of all-day events. It supports the
+// DAILY, WEEKLY, MONTHLY and YEARLY frequencies with INTERVAL, COUNT, UNTIL,
+// BYMONTH, BYMONTHDAY and BYDAY.
+type Rule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byMonth    []time.Month
+	byMonthDay []int
+	byDay      []weekdayRule
+}
+
+// ParseRule parses the value of an RRULE, e.g. FREQ=YEARLY;BYMONTH=3.
+func ParseRule(s string) (*Rule, error) {
+	r := &Rule{interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(s), "RRULE:"), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		name, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		var err error
+		switch name {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.freq = value
+			default:
+				return nil, fmt.Errorf("unsupported frequency %q", value)
+			}
+		case "INTERVAL":
+			if r.interval, err = strconv.Atoi(value); err != nil || r.interval < 1 {
+				return nil, fmt.Errorf("invalid interval %q", value)
+			}
+		case "COUNT":
+			if r.count, err = strconv.Atoi(value); err != nil || r.count < 1 {
+				return nil, fmt.Errorf("invalid count %q", value)
+			}
+		case "UNTIL":
+			if len(value) > len(dateFormat) {
+				value = value[:len(dateFormat)]
+			}
+			if r.until, err = time.Parse(dateFormat, value); err != nil {
+				return nil, fmt.Errorf("invalid until %q", kv[1])
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				m, err := strconv.Atoi(v)
+				if err != nil || m < 1 || m > 12 {
+					return nil, fmt.Errorf("invalid month %q", v)
+				}
+				r.byMonth = append(r.byMonth, time.Month(m))
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				d, err := strconv.Atoi(v)
+				if err != nil || d == 0 || d < -31 || d > 31 {
+					return nil, fmt.Errorf("invalid month day %q", v)
+				}
+				r.byMonthDay = append(r.byMonthDay, d)
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				if len(v) < 2 {
+					return nil, fmt.Errorf("invalid day %q", v)
+				}
+				weekday, ok := ruleWeekdays[v[len(v)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid day %q", v)
+				}
+				wd := weekdayRule{weekday: weekday}
+				if ordinal := strings.TrimPrefix(v[:len(v)-2], "+"); ordinal != "" {
+					if wd.ordinal, err = strconv.Atoi(ordinal); err != nil || wd.ordinal == 0 ||
+						wd.ordinal < -5 || wd.ordinal > 5 {
+						return nil, fmt.Errorf("invalid day %q", v)
+					}
+				}
+				r.byDay = append(r.byDay, wd)
+			}
+		case "WKST":
+			// weeks start on Monday
+		default:
+			return nil, fmt.Errorf("unsupported rule part %q", name)
+		}
+	}
+	if r.freq == "" {
+		return nil, fmt.Errorf("rule %q has no frequency", s)
+	}
+	if r.count > 0 && !r.until.IsZero() {
+		return nil, fmt.Errorf("rule %q has both count and until", s)
+	}
+	for _, wd := range r.byDay {
+		if wd.ordinal != 0 && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+			return nil, fmt.Errorf("ordinal days are only supported in monthly and yearly rules")
+		}
+	}
+	for _, wd := range r.byDay {
+		if wd.ordinal != 0 && r.freq == "YEARLY" && len(r.byMonth) == 0 {
+			return nil, fmt.Errorf("ordinal days of yearly rules need a month")
+		}
+	}
+	return r, nil
+}
+
+func day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func containsMonth(months []time.Month, m time.Month) bool {
+	for _, month := range months {
+		if month == m {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays returns the days of the month matching the BYMONTHDAY and BYDAY
+// parts, or the day of the month of start if there are none. With both, the
+// days must match both.
+func (r *Rule) monthDays(year int, month time.Month, start time.Time) []time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	length := first.AddDate(0, 1, -1).Day()
+	days := make([]time.Time, 0)
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 {
+		if start.Day() <= length {
+			days = append(days, first.AddDate(0, 0, start.Day()-1))
+		}
+		return days
+	}
+	for _, d := range r.byMonthDay {
+		if d < 0 {
+			d = length + d + 1
+		}
+		if d >= 1 && d <= length {
+			days = append(days, first.AddDate(0, 0, d-1))
+		}
+	}
+	if len(r.byDay) == 0 {
+		return uniqueDays(days)
+	}
+	monthDays := days
+	days = make([]time.Time, 0)
+	for _, wd := range r.byDay {
+		matching := make([]time.Time, 0, 5)
+		for d := first; d.Month() == month; d = d.AddDate(0, 0, 1) {
+			if d.Weekday() == wd.weekday {
+				matching = append(matching, d)
+			}
+		}
+		switch {
+		case wd.ordinal == 0:
+			days = append(days, matching...)
+		case wd.ordinal > 0 && wd.ordinal <= len(matching):
+			days = append(days, matching[wd.ordinal-1])
+		case wd.ordinal < 0 && -wd.ordinal <= len(matching):
+			days = append(days, matching[len(matching)+wd.ordinal])
+		}
+	}
+	if len(r.byMonthDay) > 0 {
+		days = intersectDays(days, monthDays)
+	}
+	return uniqueDays(days)
+}
+
+// uniqueDays sorts days and removes the duplicates.
+func uniqueDays(days []time.Time) []time.Time {
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	unique := days[:0]
+	for i, d := range days {
+		if i == 0 || !d.Equal(days[i-1]) {
+			unique = append(unique, d)
+		}
+	}
+	return unique
+}
+
+// intersectDays returns the days of a that are also in b.
+func intersectDays(a, b []time.Time) []time.Time {
+	days := make([]time.Time, 0, len(a))
+	for _, d := range a {
+		for _, e := range b {
+			if d.Equal(e) {
+				days = append(days, d)
+				break
+			}
+		}
+	}
+	return days
+}
+
+// periodStart returns the first day of the n-th period after start.
+func (r *Rule) periodStart(start time.Time, n int) time.Time {
+	switch r.freq {
+	case "DAILY":
+		return start.AddDate(0, 0, n*r.interval)
+	case "WEEKLY":
+		return start.AddDate(0, 0, -(int(start.Weekday())+6)%7+7*n*r.interval)
+	case "MONTHLY":
+		return time.Date(start.Year(), start.Month()+time.Month(n*r.interval), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(start.Year()+n*r.interval, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// candidates returns the days of the n-th period after start matching the
+// rule, unsorted.
+func (r *Rule) candidates(start time.Time, n int) []time.Time {
+	first := r.periodStart(start, n)
+	switch r.freq {
+	case "DAILY":
+		d := first
+		if len(r.byMonth) > 0 && !containsMonth(r.byMonth, d.Month()) {
+			return nil
+		}
+		return []time.Time{d}
+	case "WEEKLY":
+		days := make([]time.Time, 0, 7)
+		for i := 0; i < 7; i++ {
+			d := first.AddDate(0, 0, i)
+			matches := len(r.byDay) == 0 && d.Weekday() == start.Weekday()
+			for _, wd := range r.byDay {
+				matches = matches || d.Weekday() == wd.weekday
+			}
+			if matches && (len(r.byMonth) == 0 || containsMonth(r.byMonth, d.Month())) {
+				days = append(days, d)
+			}
+		}
+		return days
+	case "MONTHLY":
+		if len(r.byMonth) > 0 && !containsMonth(r.byMonth, first.Month()) {
+			return nil
+		}
+		return r.monthDays(first.Year(), first.Month(), start)
+	default:
+		year := first.Year()
+		months := r.byMonth
+		if len(months) == 0 && len(r.byMonthDay) == 0 && len(r.byDay) == 0 {
+			months = []time.Month{start.Month()}
+		} else if len(months) == 0 {
+			months = []time.Month{time.January, time.February, time.March, time.April, time.May, time.June,
+				time.July, time.August, time.September, time.October, time.November, time.December}
+		}
+		days := make([]time.Time, 0, len(months))
+		for _, m := range months {
+			days = append(days, r.monthDays(year, m, start)...)
+		}
+		return days
+	}
+}
+
+// firstPeriod returns the period the expansion can start from to find the
+// occurrences starting from the day from. The periods before it are skipped,
+// unless the occurrences are counted from the start.
+func (r *Rule) firstPeriod(start, from time.Time) int {
+	if r.count > 0 {
+		return 0
+	}
+	first := r.periodStart(start, 0)
+	var periods int
+	switch r.freq {
+	case "DAILY":
+		periods = int(from.Sub(first).Hours()/24) / r.interval
+	case "WEEKLY":
+		periods = int(from.Sub(first).Hours()/24) / (7 * r.interval)
+	case "MONTHLY":
+		periods = ((from.Year()-first.Year())*12 + int(from.Month()) - int(first.Month())) / r.interval
+	default:
+		periods = (from.Year() - first.Year()) / r.interval
+	}
+	if periods < 1 {
+		return 0
+	}
+	return periods - 1
+}
+
+// Expand returns the first days of the occurrences of an event lasting from
+// start to end that overlap the days from and to, both included. start is
+// always the first occurrence, and the exceptions are left out.
+func (r *Rule) Expand(start, end, from, to time.Time, exceptions []time.Time) []time.Time {
+	start, end, from, to = day(start), day(end), day(from), day(to)
+	length := end.Sub(start)
+	excluded := make(map[time.Time]bool, len(exceptions))
+	for _, e := range exceptions {
+		excluded[day(e)] = true
+	}
+	occurrences := make([]time.Time, 0)
+	add := func(d time.Time) {
+		if !excluded[d] && !d.After(to) && !d.Add(length).Before(from) {
+			occurrences = append(occurrences, d)
+		}
+	}
+	add(start)
+	count := 1
+	first := r.firstPeriod(start, from.Add(-length))
+	for n := first; n < first+maxPeriods && !r.periodStart(start, n).After(to); n++ {
+		days := r.candidates(start, n)
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+		for _, d := range days {
+			if !d.After(start) {
+				continue
+			}
+			if d.After(to) || (!r.until.IsZero() && d.After(r.until)) || (r.count > 0 && count >= r.count) {
+				return occurrences
+			}
+			count++
+			add(d)
+		}
+	}
+	return occurrences
+}
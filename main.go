@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/beppeben/go-dictionary/excel"
 	"github.com/beppeben/go-dictionary/persistence"
@@ -8,21 +14,56 @@ import (
 	"github.com/beppeben/go-dictionary/web"
 )
 
-func main() {
-	log.SetLevel(log.DebugLevel)
-	log.SetFormatter(&log.TextFormatter{DisableColors: true})
+// shutdownTimeout bounds how long in-flight requests are given to complete.
+const shutdownTimeout = 30 * time.Second
 
+func main() {
 	config := utils.NewAppConfig()
+	utils.SetupLogging(config)
 	sysutils := utils.NewSysUtils(config)
 	msgutils := utils.NewMessageUtils(config)
 
-	handler := persistence.NewMySqlHandler(config)
+	handler, err := persistence.NewMySqlHandler(config)
+	if err != nil {
+		log.Fatalf("Cannot connect to database: %v", err)
+	}
 	dbReader := excel.NewReader(config.GetExcelDir() + "mydb.xlsx")
 	calReader := excel.NewReader(config.GetExcelDir() + "calendar.xlsx")
-	repo := persistence.NewRepo(handler, dbReader, calReader)
+	repo, err := persistence.NewRepo(handler, dbReader, calReader)
+	if err != nil {
+		handler.Close()
+		log.Fatalf("Cannot load dictionary: %v", err)
+	}
+
+	geo, err := utils.NewGeolocator(config)
+	if err != nil {
+		handler.Close()
+		log.Fatalf("Cannot open geolocation database: %v", err)
+	}
+	defer geo.Close()
+
+	webhandler, err := web.NewWebHandler(repo, config, sysutils, msgutils, geo)
+	if err != nil {
+		handler.Close()
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	err = webhandler.StartServer()
+	if err != nil {
+		handler.Close()
+		log.Fatalf("Cannot start server: %v", err)
+	}
 
-	webhandler := web.NewWebHandler(repo, config, sysutils, msgutils)
-	webhandler.StartServer()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("Received %v", sig)
 
-	select {}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = webhandler.Shutdown(ctx); err != nil {
+		log.Warnf("Server shutdown: %v", err)
+	}
+	if err = handler.Close(); err != nil {
+		log.Warnf("Closing database: %v", err)
+	}
 }
@@ -0,0 +1,106 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const createAuditTable = "CREATE TABLE IF NOT EXISTS audit_log (" +
+	"id SERIAL PRIMARY KEY, " +
+	"time TIMESTAMPTZ NOT NULL DEFAULT now(), " +
+	"actor VARCHAR(255) NOT NULL, " +
+	"ip VARCHAR(64) NOT NULL, " +
+	"action VARCHAR(64) NOT NULL, " +
+	"file_hash CHAR(64), " +
+	"file_size BIGINT, " +
+	"outcome VARCHAR(16) NOT NULL, " +
+	"error TEXT, " +
+	"row_counts TEXT)"
+
+func (r *SqlRepo) AddAuditRecord(ctx context.Context, record *AuditRecord) error {
+	var counts sql.NullString
+	if record.RowCounts != nil {
+		b, err := json.Marshal(record.RowCounts)
+		if err != nil {
+			return err
+		}
+		counts = sql.NullString{String: string(b), Valid: true}
+	}
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		return tx.QueryRow("INSERT INTO audit_log (actor, ip, action, file_hash, file_size, outcome, error, row_counts) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, time", record.Actor, record.Ip, record.Action,
+			nullString(record.FileHash), nullInt(record.FileSize), record.Outcome, nullString(record.Error),
+			counts).Scan(&record.Id, &record.Time)
+	})
+}
+
+// GetAuditRecords returns the records matching filter, most recent first.
+func (r *SqlRepo) GetAuditRecords(ctx context.Context, filter *AuditFilter) ([]*AuditRecord, error) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+"$"+strconv.Itoa(len(args)))
+	}
+	if filter.Actor != "" {
+		where("actor=", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("action=", filter.Action)
+	}
+	if filter.Outcome != "" {
+		where("outcome=", filter.Outcome)
+	}
+	if !filter.From.IsZero() {
+		where("time>=", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("time<", filter.To)
+	}
+	query := "SELECT id, time, actor, ip, action, file_hash, file_size, outcome, error, row_counts FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	rows, err := r.handler.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]*AuditRecord, 0)
+	for rows.Next() {
+		record := &AuditRecord{}
+		var hash, errString, counts sql.NullString
+		var size sql.NullInt64
+		err = rows.Scan(&record.Id, &record.Time, &record.Actor, &record.Ip, &record.Action,
+			&hash, &size, &record.Outcome, &errString, &counts)
+		if err != nil {
+			return nil, err
+		}
+		record.FileHash, record.FileSize, record.Error = hash.String, size.Int64, errString.String
+		if counts.Valid {
+			if err = json.Unmarshal([]byte(counts.String), &record.RowCounts); err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt(i int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: i, Valid: i != 0}
+}
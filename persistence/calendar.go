@@ -0,0 +1,304 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/ical"
+)
+
+// exceptions are stored as a comma separated list of days
+const exceptionFormat = "2006-01-02"
+
+// cal_english is normally created from the calendar workbook, the same
+// columns are used when events are imported before any workbook
+const createCalendarTable = "CREATE TABLE IF NOT EXISTS cal_english (" +
+	"id INT PRIMARY KEY, " +
+	"start_date DATE, " +
+	"end_date DATE, " +
+	"tag VARCHAR(255), " +
+	"title VARCHAR(255), " +
+	"description VARCHAR(10000), " +
+	"recurrence VARCHAR(255), " +
+	"exceptions VARCHAR(10000))"
+
+// calendarQuery returns the columns and tables to select the events from,
+// with their title and description in lang. Translations come from the
+// cal_<lang> tables, with the English text where they are missing.
+func (r *SqlRepo) calendarQuery(lang string) (columns, tables string) {
+	columns = "c.id, c.start_date, c.end_date, c.tag, "
+	if !r.calendarTranslated(lang) {
+		return columns + "c.title, c.description, c.uid, c.recurrence, c.exceptions", "cal_english c"
+	}
+	return columns + "COALESCE(NULLIF(t.title, ''), c.title), COALESCE(NULLIF(t.description, ''), c.description), " +
+			"c.uid, c.recurrence, c.exceptions",
+		"cal_english c LEFT JOIN cal_" + lang + " t ON t.id = c.id"
+}
+
+func (r *SqlRepo) calendarTranslated(lang string) bool {
+	r.cache.RLock()
+	defer r.cache.RUnlock()
+	return lang != "english" && r.calLanguages[lang]
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// GetCalendarRange returns the events matching filter, in lang and by start
+// date. Recurring events are expanded into their occurrences in the range.
+func (r *SqlRepo) GetCalendarRange(ctx context.Context, filter *CalendarFilter, lang string) ([]*CalendarEvent, error) {
+	columns, tables := r.calendarQuery(lang)
+	from, to := day(filter.From), day(filter.To)
+	st := "SELECT " + columns + " FROM " + tables + " WHERE c.start_date <= $1 AND " +
+		"(c.end_date >= $2 OR COALESCE(c.recurrence, '') <> '')"
+	args := []interface{}{to, from}
+	if filter.Tag != "" {
+		args = append(args, filter.Tag)
+		st += " AND lower(c.tag) = lower($" + strconv.Itoa(len(args)) + ")"
+	}
+	if filter.Query != "" {
+		args = append(args, "%"+likeEscaper.Replace(filter.Query)+"%")
+		n := "$" + strconv.Itoa(len(args))
+		st += " AND (c.title ILIKE " + n + " OR c.description ILIKE " + n
+		if r.calendarTranslated(lang) {
+			st += " OR t.title ILIKE " + n + " OR t.description ILIKE " + n
+		}
+		st += ")"
+	}
+	rows, err := r.handler.QueryContext(ctx, st+" ORDER BY c.start_date, c.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	events, err := scanCalendarEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	return expandRecurrences(events, from, to), nil
+}
+
+func day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// refreshCalendarLanguages finds the languages with translated events.
+func (r *SqlRepo) refreshCalendarLanguages(ctx context.Context, tx QueryObj) error {
+	calLanguages := make(map[string]bool)
+	for _, lang := range r.getLanguages() {
+		rows, err := tx.QueryContext(ctx, "SELECT to_regclass($1) IS NOT NULL", "cal_"+lang)
+		if err != nil {
+			return err
+		}
+		var exists bool
+		for rows.Next() {
+			err = rows.Scan(&exists)
+		}
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		calLanguages[lang] = exists
+	}
+	r.cache.Lock()
+	r.calLanguages = calLanguages
+	r.cache.Unlock()
+	return nil
+}
+
+func scanCalendarEvents(rows *sql.Rows) ([]*CalendarEvent, error) {
+	defer rows.Close()
+	events := make([]*CalendarEvent, 0)
+	for rows.Next() {
+		event := &CalendarEvent{}
+		var uid, recurrence, exceptions sql.NullString
+		err := rows.Scan(&event.Id, &event.StartDate, &event.EndDate, &event.Tag, &event.Title, &event.Description,
+			&uid, &recurrence, &exceptions)
+		if err != nil {
+			return nil, err
+		}
+		event.UID = uid.String
+		event.Recurrence = strings.TrimSpace(recurrence.String)
+		if event.Exceptions, err = parseExceptions(exceptions.String); err != nil {
+			log.Warnf("Ignoring exceptions of calendar event %d: %v", event.Id, err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func parseExceptions(s string) ([]time.Time, error) {
+	exceptions := make([]time.Time, 0)
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		d, err := time.Parse(exceptionFormat, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exception %q", value)
+		}
+		exceptions = append(exceptions, d)
+	}
+	return exceptions, nil
+}
+
+func formatExceptions(exceptions []time.Time) string {
+	days := make([]string, len(exceptions))
+	for i, d := range exceptions {
+		days[i] = d.Format(exceptionFormat)
+	}
+	return strings.Join(days, ",")
+}
+
+// expandRecurrences replaces the recurring events with their occurrences
+// overlapping the days from and to, sorted by start date. Events with an
+// invalid rule are kept as they are.
+func expandRecurrences(events []*CalendarEvent, from, to time.Time) []*CalendarEvent {
+	expanded := make([]*CalendarEvent, 0, len(events))
+	for _, e := range events {
+		if e.Recurrence == "" {
+			expanded = append(expanded, e)
+			continue
+		}
+		rule, err := ical.ParseRule(e.Recurrence)
+		if err != nil {
+			log.Warnf("Ignoring recurrence of calendar event %d: %v", e.Id, err)
+			if !e.EndDate.Before(from) && !e.StartDate.After(to) {
+				expanded = append(expanded, e)
+			}
+			continue
+		}
+		for _, start := range rule.Expand(e.StartDate, e.EndDate, from, to, e.Exceptions) {
+			occurrence := *e
+			occurrence.StartDate = start
+			occurrence.EndDate = start.Add(e.EndDate.Sub(e.StartDate))
+			expanded = append(expanded, &occurrence)
+		}
+	}
+	sort.SliceStable(expanded, func(i, j int) bool { return expanded[i].StartDate.Before(expanded[j].StartDate) })
+	return expanded
+}
+
+// checkRecurrences returns an error naming the first event with an invalid
+// rule or exception.
+func checkRecurrences(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, recurrence, exceptions FROM cal_english " +
+		"WHERE COALESCE(recurrence, '') <> '' OR COALESCE(exceptions, '') <> ''")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var recurrence, exceptions sql.NullString
+		if err = rows.Scan(&id, &recurrence, &exceptions); err != nil {
+			return err
+		}
+		if strings.TrimSpace(recurrence.String) != "" {
+			if _, err = ical.ParseRule(recurrence.String); err != nil {
+				return fmt.Errorf("Calendar event %d: %v", id, err)
+			}
+		}
+		if _, err = parseExceptions(exceptions.String); err != nil {
+			return fmt.Errorf("Calendar event %d: %v", id, err)
+		}
+	}
+	return rows.Err()
+}
+
+// upgradeCalendarTable adds the UIDs of imported events and the optional
+// recurrence columns to a calendar table created from the workbook.
+func upgradeCalendarTable(tx *sql.Tx) error {
+	for _, st := range []string{"ALTER TABLE cal_english ADD COLUMN IF NOT EXISTS uid VARCHAR(255)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS cal_english_uid ON cal_english(uid)",
+		"ALTER TABLE cal_english ADD COLUMN IF NOT EXISTS recurrence VARCHAR(255)",
+		"ALTER TABLE cal_english ADD COLUMN IF NOT EXISTS exceptions VARCHAR(10000)"} {
+		if _, err := tx.Exec(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearCalendarTranslations empties the cal_<lang> tables, keeping them.
+func clearCalendarTranslations(tx *sql.Tx, languages []string) error {
+	for _, lang := range languages {
+		if lang == "english" {
+			continue
+		}
+		var exists bool
+		if err := tx.QueryRow("SELECT to_regclass($1) IS NOT NULL", "cal_"+lang).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM cal_" + lang); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportCalendarEvents adds events to the calendar, updating those with the
+// same UID. With replace, the events already in the calendar are removed
+// first, with their translations, since the new events reuse their ids. It
+// returns the number of events added, updated and removed.
+func (r *SqlRepo) ImportCalendarEvents(ctx context.Context, events []*CalendarEvent, replace bool) (counts map[string]int, err error) {
+	counts = make(map[string]int)
+	err = r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createCalendarTable); err != nil {
+			return err
+		}
+		if err := upgradeCalendarTable(tx); err != nil {
+			return err
+		}
+		if replace {
+			res, err := tx.Exec("DELETE FROM cal_english")
+			if err != nil {
+				return err
+			}
+			removed, _ := res.RowsAffected()
+			counts["removed"] = int(removed)
+			if err := clearCalendarTranslations(tx, r.getLanguages()); err != nil {
+				return err
+			}
+		}
+		var nextId int64
+		if err := tx.QueryRow("SELECT COALESCE(max(id), 0) + 1 FROM cal_english").Scan(&nextId); err != nil {
+			return err
+		}
+		for _, e := range events {
+			exceptions := formatExceptions(e.Exceptions)
+			res, err := tx.Exec("UPDATE cal_english SET start_date=$1, end_date=$2, tag=$3, title=$4, description=$5, "+
+				"recurrence=$6, exceptions=$7 WHERE uid=$8", e.StartDate, e.EndDate, e.Tag, e.Title, e.Description,
+				e.Recurrence, exceptions, e.UID)
+			if err != nil {
+				return err
+			}
+			if updated, _ := res.RowsAffected(); updated > 0 {
+				counts["updated"]++
+				continue
+			}
+			_, err = tx.Exec("INSERT INTO cal_english (id, start_date, end_date, tag, title, description, uid, "+
+				"recurrence, exceptions) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", nextId, e.StartDate, e.EndDate,
+				e.Tag, e.Title, e.Description, e.UID, e.Recurrence, exceptions)
+			if err != nil {
+				return err
+			}
+			e.Id = nextId
+			nextId++
+			counts["added"]++
+		}
+		return nil
+	})
+	if err == nil && replace {
+		err = r.refreshCalendarLanguages(ctx, r.handler)
+	}
+	return
+}
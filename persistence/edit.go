@@ -0,0 +1,85 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	. "github.com/beppeben/go-dictionary/utils"
+)
+
+var editableFields = []string{"word", "description", "definition", "loc"}
+
+// UpdateWebTerm changes the web string key in language lang.
+// Like any edit made through the web interface, it is lost when a new
+// workbook is deployed.
+func (r *SqlRepo) UpdateWebTerm(ctx context.Context, lang, key, value string) error {
+	r.cache.RLock()
+	english, ok := r.webStrings["eng"+key]
+	r.cache.RUnlock()
+	// id is the language of the row, not a string
+	if !ok || strings.ToLower(key) == "id" {
+		return fmt.Errorf("Unknown web string %s", key)
+	}
+	err := r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE web SET "+key+"=$1 WHERE lower(id)=$2", value, lang)
+		return checkAffected(res, err, "language "+lang)
+	})
+	if err != nil {
+		return err
+	}
+	if value == "" && lang[:3] != "eng" {
+		value = english
+	}
+	r.cache.Lock()
+	r.webStrings[lang[:3]+key] = value
+	r.cache.Unlock()
+	return nil
+}
+
+// UpdateEntry changes a field of the entry word, translating the concept
+// enId, in the table of language lang.
+func (r *SqlRepo) UpdateEntry(ctx context.Context, lang string, enId int64, word, field, value string) error {
+	if r.GetLangFromKey(ctx, lang[:3]) != lang {
+		return fmt.Errorf("Unknown language %s", lang)
+	}
+	if !Contains(editableFields, field) {
+		return fmt.Errorf("Field %s cannot be edited", field)
+	}
+	idColumn := "english_id"
+	if lang == "english" {
+		idColumn = "id"
+	}
+	err := r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE "+lang+" SET "+field+"=$1 WHERE "+idColumn+"=$2 AND word=$3",
+			value, enId, word)
+		return checkAffected(res, err, "entry "+word)
+	})
+	if err != nil {
+		return err
+	}
+	if field == "word" {
+		// the edit is committed, refresh even if the request goes away
+		r.refreshLanguageWords(WithLogger(context.Background(), Logger(ctx)), lang)
+	}
+	return nil
+}
+
+// refreshLanguageWords reloads the cached dictionaries of lang, after one of
+// its words changed. Those that cannot be read are dropped from the cache,
+// to be loaded again on the next autocompletion.
+func (r *SqlRepo) refreshLanguageWords(ctx context.Context, lang string) {
+	for _, other := range r.getLanguages() {
+		if other == lang {
+			continue
+		}
+		words1, words2, err := r.loadWords(ctx, lang, other)
+		if err != nil {
+			Logger(ctx).Warnf("Cannot reload the words of %s-%s: %v", lang, other, err)
+			r.dropWords(lang, other)
+			continue
+		}
+		r.setWords(lang, other, words1, words2)
+	}
+}
@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+// GetTableNames returns the dictionary tables in the order ResetDB creates them.
+func (r *SqlRepo) GetTableNames(ctx context.Context) []string {
+	tables := []string{"languages", "fields", "fields_expl", "genre", "web", "english"}
+	for _, lang := range r.getLanguages() {
+		if lang != "english" {
+			tables = append(tables, lang)
+		}
+	}
+	return tables
+}
+
+// GetTableMatrix dumps a table as a matrix of strings, with the column names
+// in the first row, in the same layout the excel reader produces. The ids
+// generated for the translation tables are left out, as the workbook has
+// none.
+func (r *SqlRepo) GetTableMatrix(ctx context.Context, title string) ([][]string, error) {
+	if !utils.Contains(r.GetTableNames(ctx), title) && title != "cal_english" {
+		return nil, fmt.Errorf("Unknown table %s", title)
+	}
+	autoId := title != "english" && utils.Contains(r.getLanguages(), title)
+	rows, err := r.handler.QueryContext(ctx, "SELECT * FROM "+title+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	skip := -1
+	if autoId {
+		skip = columnIndex(columns, "id")
+	}
+	matrix := [][]string{withoutColumn(columns, skip)}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, value := range values {
+			row[i] = formatValue(value)
+		}
+		matrix = append(matrix, withoutColumn(row, skip))
+	}
+	return matrix, rows.Err()
+}
+
+// withoutColumn returns row without the column i, or row if i is negative.
+func withoutColumn(row []string, i int) []string {
+	if i < 0 {
+		return row
+	}
+	return append(row[:i:i], row[i+1:]...)
+}
+
+// GetTableColumns returns the column names of a dictionary table.
+func (r *SqlRepo) GetTableColumns(ctx context.Context, title string) ([]string, error) {
+	if !utils.Contains(r.GetTableNames(ctx), title) {
+		return nil, fmt.Errorf("Unknown table %s", title)
+	}
+	rows, err := r.handler.QueryContext(ctx, "SELECT * FROM "+title+" LIMIT 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return v.Format("2006-01-02")
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,91 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const createFeedbackTable = "CREATE TABLE IF NOT EXISTS feedback (" +
+	"id SERIAL PRIMARY KEY, " +
+	"concept_id BIGINT NOT NULL, " +
+	"lang VARCHAR(64) NOT NULL, " +
+	"word VARCHAR(255) NOT NULL, " +
+	"category VARCHAR(32) NOT NULL, " +
+	"comment TEXT NOT NULL, " +
+	"ip VARCHAR(64) NOT NULL, " +
+	"created TIMESTAMPTZ NOT NULL DEFAULT now(), " +
+	"resolved BOOLEAN NOT NULL DEFAULT false)"
+
+// the address of the reporter is only kept for rate limiting, it is never read back
+const selectFeedback = "SELECT id, concept_id, lang, word, category, comment, created, resolved FROM feedback"
+
+// AddFeedback stores a report, provided the word is an entry of concept
+// f.ConceptId in language f.Lang and that f.Ip sent fewer than perHour
+// reports in the last hour, or returns ErrRateLimited.
+func (r *SqlRepo) AddFeedback(ctx context.Context, f *Feedback, perHour int) error {
+	if !utils.Contains(r.getLanguages(), f.Lang) {
+		return fmt.Errorf("Unknown language %s", f.Lang)
+	}
+	idColumn := "english_id"
+	if f.Lang == "english" {
+		idColumn = "id"
+	}
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		var found bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM "+f.Lang+" WHERE "+idColumn+"=$1 AND word=$2)",
+			f.ConceptId, f.Word).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("No entry %s (%d) in %s", f.Word, f.ConceptId, f.Lang)
+		}
+		if err = takeRate(tx, "feedback", f.Ip, perHour, time.Now().Add(-time.Hour)); err != nil {
+			return err
+		}
+		return tx.QueryRow("INSERT INTO feedback (concept_id, lang, word, category, comment, ip) "+
+			"VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created", f.ConceptId, f.Lang, f.Word,
+			f.Category, f.Comment, f.Ip).Scan(&f.Id, &f.Created)
+	})
+}
+
+// GetOpenFeedback returns the unresolved reports, grouped by entry. If
+// conceptId is not 0, only the reports on that concept in lang are returned.
+func (r *SqlRepo) GetOpenFeedback(ctx context.Context, lang string, conceptId int64) ([]*Feedback, error) {
+	var rows *sql.Rows
+	var err error
+	order := " ORDER BY lang, concept_id, created DESC"
+	if conceptId == 0 {
+		rows, err = r.handler.QueryContext(ctx, selectFeedback+" WHERE NOT resolved"+order)
+	} else {
+		rows, err = r.handler.QueryContext(ctx, selectFeedback+" WHERE NOT resolved AND lang=$1 AND concept_id=$2"+order,
+			lang, conceptId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	feedback := make([]*Feedback, 0)
+	for rows.Next() {
+		f := &Feedback{}
+		err = rows.Scan(&f.Id, &f.ConceptId, &f.Lang, &f.Word, &f.Category, &f.Comment, &f.Created, &f.Resolved)
+		if err != nil {
+			return nil, err
+		}
+		feedback = append(feedback, f)
+	}
+	return feedback, rows.Err()
+}
+
+func (r *SqlRepo) ResolveFeedback(ctx context.Context, id int64) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE feedback SET resolved=true WHERE id=$1", id)
+		return checkAffected(res, err, "feedback "+strconv.FormatInt(id, 10))
+	})
+}
@@ -2,21 +2,27 @@ package persistence
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	. "github.com/beppeben/go-dictionary/domain"
 	"github.com/beppeben/go-dictionary/excel"
+	. "github.com/beppeben/go-dictionary/utils"
 )
 
 type DbHandler interface {
-	Conn() *sql.DB
-	Transact(txFunc func(*sql.Tx) (interface{}, error)) (interface{}, error)
-	TransactNoRet(txFunc func(*sql.Tx) error) error
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	Ping(ctx context.Context) error
+	Stats() sql.DBStats
+	Transact(ctx context.Context, txFunc func(*sql.Tx) (interface{}, error)) (interface{}, error)
+	TransactNoRet(ctx context.Context, txFunc func(*sql.Tx) error) error
 }
 
 type SqlRepo struct {
@@ -32,24 +38,74 @@ type SqlRepo struct {
 	langMatrix map[string]string
 	//webStrings["lang" + "key"] contains web entry "key" in language "lang"
 	webStrings map[string]string
+	//calLanguages["lang"] tells if events are translated in "lang"
+	calLanguages map[string]bool
+	// cache guards the languages and everything cached above, which change
+	// while serving
+	cache  sync.RWMutex
+	status repoStatus
 }
 
 type ImportOptions struct {
+	// CheckHeaders checks the column headers against Languages
 	CheckHeaders bool
+	Languages    []string
 	AutoId       bool
 	Square       bool
 	FromCalendar bool
 }
 
-func NewRepo(h DbHandler, r *excel.ExcelReader, c *excel.ExcelReader) *SqlRepo {
+func NewRepo(h DbHandler, r *excel.ExcelReader, c *excel.ExcelReader) (*SqlRepo, error) {
 	repo := &SqlRepo{handler: h, dbReader: r, calReader: c}
-	repo.refreshLanguages()
-	repo.refreshLanguageMaps()
-	repo.refreshWordsCache()
-	return repo
+	ctx := context.Background()
+	err := repo.createAdminTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = repo.refreshCaches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repo.loadMeta(ctx)
+	return repo, nil
 }
 
-func (r *SqlRepo) GetLanguages(base string) []*Language {
+// refreshCaches reloads the languages, the language maps and the words cache.
+// A missing languages table is not an error: the database is simply empty.
+// If the refresh fails, the previous caches are kept, and so is readiness.
+func (r *SqlRepo) refreshCaches(ctx context.Context) (err error) {
+	wasReady := r.GetStatus(ctx).Ready
+	r.setReady(false)
+	defer func() {
+		if err != nil {
+			Logger(ctx).Errorf("Cannot refresh caches: %v", err)
+			r.setReady(wasReady)
+		}
+	}()
+	languages, err := r.loadLanguages(ctx, r.handler)
+	if err != nil {
+		Logger(ctx).Debugf("No languages: %v", err)
+		languages, err = []string{}, nil
+	}
+	err = r.refreshLanguageMaps(ctx, languages)
+	if err != nil {
+		return err
+	}
+	err = r.refreshWordsCache(ctx, languages)
+	if err != nil {
+		return err
+	}
+	err = r.refreshCalendarLanguages(ctx, r.handler)
+	if err != nil {
+		return err
+	}
+	r.setReady(true)
+	return nil
+}
+
+func (r *SqlRepo) GetLanguages(ctx context.Context, base string) []*Language {
+	r.cache.RLock()
+	defer r.cache.RUnlock()
 	result := make([]*Language, len(r.languages))
 	for i, _ := range r.languages {
 		lang := r.langMatrix[r.languages[i][:3]+base[:3]]
@@ -77,7 +133,8 @@ func getDbType(sample string, title string) string {
 	if title == "english_id" {
 		return "INT NOT NULL"
 	}
-	if title == "description" || title == "definition" || title == "about_html" || title == "terms_html" {
+	if title == "description" || title == "definition" || title == "about_html" || title == "terms_html" ||
+		title == "exceptions" {
 		return "VARCHAR(10000)"
 	}
 	if strings.Contains(title, "date") {
@@ -87,38 +144,45 @@ func getDbType(sample string, title string) string {
 }
 
 type QueryObj interface {
-	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 }
 
-func (r *SqlRepo) refreshWordsCache() {
-	log.Info("Refreshing words cache")
-	r.allWords = make(map[string]*SimpleWordsPair)
-	for i := 1; i < len(r.languages); i++ {
+func (r *SqlRepo) refreshWordsCache(ctx context.Context, languages []string) error {
+	Logger(ctx).Info("Refreshing words cache")
+	allWords := make(map[string]*SimpleWordsPair)
+	for i := 1; i < len(languages); i++ {
 		for j := 0; j < i; j++ {
-			l1 := r.languages[i]
-			l2 := r.languages[j]
-			_, _, err := r.GetWords(l1, l2)
+			l1 := languages[i]
+			l2 := languages[j]
+			words1, words2, err := r.loadWords(ctx, l1, l2)
 			if err != nil {
-				panic(err.Error())
+				return err
 			}
+			allWords[l1+l2] = &SimpleWordsPair{First: words1, Second: words2}
+			allWords[l2+l1] = &SimpleWordsPair{First: words2, Second: words1}
 		}
 	}
+	r.cache.Lock()
+	r.allWords = allWords
+	r.cache.Unlock()
+	return nil
 }
 
-func (r *SqlRepo) GetWebTerm(lang, key string) string {
+func (r *SqlRepo) GetWebTerm(ctx context.Context, lang, key string) string {
+	r.cache.RLock()
+	defer r.cache.RUnlock()
 	return r.webStrings[lang[:3]+key]
 }
 
-func (r *SqlRepo) saveWebTerms(lang string) {
-	rows, err := r.handler.Conn().Query("SELECT * FROM web WHERE lower(id)=$1", lang)
+func (r *SqlRepo) saveWebTerms(ctx context.Context, lang string, webStrings map[string]string) error {
+	rows, err := r.handler.QueryContext(ctx, "SELECT * FROM web WHERE lower(id)=$1", lang)
 	if err != nil {
-		return
-		//panic(err.Error())
+		return nil
 	}
 	defer rows.Close()
 	columns, err := rows.Columns()
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 	terms := make([]string, len(columns))
 	pointers := make([]interface{}, len(columns))
@@ -128,72 +192,97 @@ func (r *SqlRepo) saveWebTerms(lang string) {
 	if rows.Next() {
 		err = rows.Scan(pointers...)
 		if err != nil {
-			panic(err.Error())
+			return err
 		}
 		for i, _ := range columns {
-			r.webStrings[lang[:3]+columns[i]] = terms[i]
+			webStrings[lang[:3]+columns[i]] = terms[i]
 		}
 	}
+	return nil
 }
 
-func (r *SqlRepo) fillMissingWebTerms() {
-	for key := range r.webStrings {
+func fillMissingWebTerms(webStrings map[string]string) {
+	for key := range webStrings {
 		if key[:3] == "eng" {
 			continue
 		}
-		if r.webStrings[key] == "" {
-			r.webStrings[key] = r.webStrings["eng"+key[3:]]
+		if webStrings[key] == "" {
+			webStrings[key] = webStrings["eng"+key[3:]]
 		}
 	}
 }
 
-func (r *SqlRepo) refreshLanguageMaps() {
-	log.Info("Refreshing language maps")
-	r.langMap = make(map[string]string)
-	r.langMatrix = make(map[string]string)
-	r.webStrings = make(map[string]string)
-
-	for _, lang := range r.languages {
-		r.saveWebTerms(lang)
-		r.langMap[lang[:3]] = lang
-		for _, other := range r.languages {
-			rows, err := r.handler.Conn().Query("SELECT "+lang+" FROM languages WHERE lower(id)=$1", other)
+// refreshLanguageMaps rebuilds the language maps and the web strings of
+// languages, and swaps them in along with the languages once complete.
+func (r *SqlRepo) refreshLanguageMaps(ctx context.Context, languages []string) error {
+	Logger(ctx).Info("Refreshing language maps")
+	langMap := make(map[string]string)
+	langMatrix := make(map[string]string)
+	webStrings := make(map[string]string)
+
+	for _, lang := range languages {
+		if err := r.saveWebTerms(ctx, lang, webStrings); err != nil {
+			return err
+		}
+		langMap[lang[:3]] = lang
+		for _, other := range languages {
+			rows, err := r.handler.QueryContext(ctx, "SELECT "+lang+" FROM languages WHERE lower(id)=$1", other)
 			if err != nil {
-				panic(err.Error())
+				return err
 			}
 			defer rows.Close()
 			var tran string
 			rows.Next()
 			rows.Scan(&tran)
-			r.langMatrix[lang[:3]+other[:3]] = strings.ToLower(tran)
+			langMatrix[lang[:3]+other[:3]] = strings.ToLower(tran)
 		}
 	}
 
-	r.fillMissingWebTerms()
+	fillMissingWebTerms(webStrings)
+	r.cache.Lock()
+	r.languages, r.langMap, r.langMatrix, r.webStrings = languages, langMap, langMatrix, webStrings
+	r.cache.Unlock()
+	return nil
 }
 
-func (r *SqlRepo) GetLangFromKey(key string) string {
+func (r *SqlRepo) GetLangFromKey(ctx context.Context, key string) string {
+	r.cache.RLock()
+	defer r.cache.RUnlock()
 	return r.langMap[key]
 }
 
-func (r *SqlRepo) refreshLanguagesFromTx(tx QueryObj) error {
-	rows, err := tx.Query("SELECT id FROM languages")
+// getLanguages returns the languages of the dictionary. The slice is
+// replaced, never modified, when the caches are refreshed.
+func (r *SqlRepo) getLanguages() []string {
+	r.cache.RLock()
+	defer r.cache.RUnlock()
+	return r.languages
+}
+
+// langName returns the name of lang in base, both given by their key.
+func (r *SqlRepo) langName(lang, base string) string {
+	r.cache.RLock()
+	defer r.cache.RUnlock()
+	return r.langMatrix[lang+base]
+}
+
+// loadLanguages reads the languages of the dictionary, without publishing
+// them, as tx may still be rolled back.
+func (r *SqlRepo) loadLanguages(ctx context.Context, tx QueryObj) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM languages")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 	result := make([]string, 0)
 	var lang string
 	for rows.Next() {
-		rows.Scan(&lang)
+		if err = rows.Scan(&lang); err != nil {
+			return nil, err
+		}
 		result = append(result, strings.ToLower(lang))
 	}
-	r.languages = result
-	return nil
-}
-
-func (r *SqlRepo) refreshLanguages() error {
-	return r.refreshLanguagesFromTx(r.handler.Conn())
+	return result, rows.Err()
 }
 
 func checkError(err error, table string) {
@@ -202,7 +291,8 @@ func checkError(err error, table string) {
 	}
 }
 
-func (r *SqlRepo) createTableFromMatrix(tx *sql.Tx, title string, matrix [][]string, autoId bool) {
+// createTableFromMatrix creates and fills a table, returning the number of rows inserted.
+func (r *SqlRepo) createTableFromMatrix(tx *sql.Tx, title string, matrix [][]string, autoId bool) int {
 	st_create := "CREATE TABLE " + title + "(id "
 	st_insert := "INSERT INTO " + title + "("
 	db_types := make([]string, len(matrix[0]))
@@ -258,22 +348,23 @@ func (r *SqlRepo) createTableFromMatrix(tx *sql.Tx, title string, matrix [][]str
 	log.Debug(vals)
 	_, err = tx.Exec(st_insert, vals...)
 	checkError(err, title)
+	return len(matrix) - 1
 }
 
-func (r *SqlRepo) checkLanguageHeaders(title string, headers []string) error {
-	if len(headers) < len(r.languages) {
+func checkLanguageHeaders(title string, headers []string, languages []string) error {
+	if len(headers) < len(languages) {
 		return fmt.Errorf("Table %v does not contain all the language columns: "+
-			"expected %d, got %d", title, len(r.languages), len(headers))
+			"expected %d, got %d", title, len(languages), len(headers))
 	}
-	headers_sorted := make([]string, len(r.languages))
-	languages_sorted := make([]string, len(r.languages))
-	for i := 0; i < len(r.languages); i++ {
+	headers_sorted := make([]string, len(languages))
+	languages_sorted := make([]string, len(languages))
+	for i := 0; i < len(languages); i++ {
 		headers_sorted[i] = strings.ToLower(headers[i])
-		languages_sorted[i] = strings.ToLower(r.languages[i])
+		languages_sorted[i] = strings.ToLower(languages[i])
 	}
 	sort.Strings(headers_sorted)
 	sort.Strings(languages_sorted)
-	for i := 0; i < len(r.languages); i++ {
+	for i := 0; i < len(languages); i++ {
 		if headers_sorted[i] != languages_sorted[i] {
 			return fmt.Errorf("Some languages are missing from Table %v", title)
 		}
@@ -281,7 +372,16 @@ func (r *SqlRepo) checkLanguageHeaders(title string, headers []string) error {
 	return nil
 }
 
-func (r *SqlRepo) createTable(tx *sql.Tx, title string, opts *ImportOptions) {
+func checkSquare(title string, matrix [][]string) error {
+	for i := 1; i < len(matrix[0]); i++ {
+		if i >= len(matrix) || matrix[0][i] != matrix[i][0] {
+			return fmt.Errorf("Row and column ids of %v matrix must coincide", title)
+		}
+	}
+	return nil
+}
+
+func (r *SqlRepo) createTable(tx *sql.Tx, title string, opts *ImportOptions) int {
 	log.Infof("Creating %v table", title)
 	var matrix [][]string
 	var err error
@@ -292,51 +392,88 @@ func (r *SqlRepo) createTable(tx *sql.Tx, title string, opts *ImportOptions) {
 	}
 	checkError(err, title)
 	if opts.Square {
-		for i := 1; i < len(matrix[0]); i++ {
-			if matrix[0][i] != matrix[i][0] {
-				panic(fmt.Errorf("Row and column ids of %v matrix must coincide", title))
-			}
+		err = checkSquare(title, matrix)
+		if err != nil {
+			panic(err.Error())
 		}
 	}
 	if opts.CheckHeaders {
-		err = r.checkLanguageHeaders(title, matrix[0][1:])
+		err = checkLanguageHeaders(title, matrix[0][1:], opts.Languages)
 		if err != nil {
 			panic(err.Error())
 		}
 	}
-	r.createTableFromMatrix(tx, title, matrix, opts.AutoId)
+	return r.createTableFromMatrix(tx, title, matrix, opts.AutoId)
 }
 
-func (r *SqlRepo) ResetCalendar() error {
-	err := r.calReader.RefreshFile()
+// ResetCalendar reimports the calendar, returning the number of rows
+// imported per table.
+func (r *SqlRepo) ResetCalendar(ctx context.Context) (counts map[string]int, err error) {
+	err = r.calReader.RefreshFile()
 	if err != nil {
-		return err
+		return
 	}
-	err = r.handler.TransactNoRet(func(tx *sql.Tx) error {
+	counts = make(map[string]int)
+	languages := r.getLanguages()
+	err = r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
 		tx.Exec("DROP TABLE IF EXISTS cal_english")
 		var err error
 		if err = r.calReader.RefreshFile(); err != nil {
 			panic(err.Error())
 		}
-		r.createTable(tx, "cal_english", &ImportOptions{FromCalendar: true})
-		return err
+		counts["cal_english"] = r.createTable(tx, "cal_english", &ImportOptions{FromCalendar: true})
+		// translations are optional, one cal_<lang> sheet per language
+		for _, lang := range languages {
+			if lang == "english" {
+				continue
+			}
+			title := "cal_" + lang
+			tx.Exec("DROP TABLE IF EXISTS " + title)
+			if _, err := r.calReader.GetSheet(title); err != nil {
+				continue
+			}
+			matrix, err := r.calReader.GetMatrix(title)
+			checkError(err, title)
+			if len(matrix) > 1 {
+				counts[title] = r.createTableFromMatrix(tx, title, matrix, false)
+			}
+		}
+		if err = upgradeCalendarTable(tx); err != nil {
+			return err
+		}
+		return checkRecurrences(tx)
 	})
-	return err
+	if err == nil {
+		err = r.refreshCalendarLanguages(ctx, r.handler)
+	}
+	return
 }
 
-func (r *SqlRepo) ResetDB() error {
-	err := r.dbReader.RefreshFile()
+// ResetDB reimports the dictionary, returning the number of rows imported
+// per table.
+func (r *SqlRepo) ResetDB(ctx context.Context) (counts map[string]int, err error) {
+	r.setImporting(true)
+	defer r.setImporting(false)
+	err = r.dbReader.RefreshFile()
 	if err != nil {
-		return err
+		return
+	}
+	version, err := r.dbReader.Checksum()
+	if err != nil {
+		return
 	}
-	err = r.handler.TransactNoRet(func(tx *sql.Tx) error {
-		log.Debugf("%d languages currently stored", len(r.languages))
-		if len(r.languages) > 0 {
-			log.Info("Removing all tables")
+	counts = make(map[string]int)
+	now := time.Now()
+	// the new languages are only published by refreshCaches, once committed
+	old := r.getLanguages()
+	err = r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		Logger(ctx).Debugf("%d languages currently stored", len(old))
+		if len(old) > 0 {
+			Logger(ctx).Info("Removing all tables")
 			tx.Exec("DROP TABLE IF EXISTS web")
 			tx.Exec("DROP TABLE IF EXISTS fields_expl")
 			tx.Exec("DROP TABLE IF EXISTS languages")
-			for _, lang := range r.languages {
+			for _, lang := range old {
 				if lang == "english" {
 					continue
 				}
@@ -350,21 +487,22 @@ func (r *SqlRepo) ResetDB() error {
 		if err = r.dbReader.RefreshFile(); err != nil {
 			panic(err.Error())
 		}
-		r.createTable(tx, "languages", &ImportOptions{Square: true})
-		r.refreshLanguagesFromTx(tx)
-		r.createTable(tx, "fields", &ImportOptions{CheckHeaders: true})
-		r.createTable(tx, "fields_expl", &ImportOptions{CheckHeaders: true})
+		counts["languages"] = r.createTable(tx, "languages", &ImportOptions{Square: true})
+		languages, err := r.loadLanguages(ctx, tx)
+		checkError(err, "languages")
+		counts["fields"] = r.createTable(tx, "fields", &ImportOptions{CheckHeaders: true, Languages: languages})
+		counts["fields_expl"] = r.createTable(tx, "fields_expl", &ImportOptions{CheckHeaders: true, Languages: languages})
 		_, err = tx.Exec("ALTER TABLE fields_expl ADD FOREIGN KEY(id) REFERENCES fields(id)")
 		checkError(err, "fields_expl")
-		r.createTable(tx, "genre", &ImportOptions{CheckHeaders: true})
+		counts["genre"] = r.createTable(tx, "genre", &ImportOptions{CheckHeaders: true, Languages: languages})
 
-		r.createTable(tx, "web", &ImportOptions{})
+		counts["web"] = r.createTable(tx, "web", &ImportOptions{})
 		_, err = tx.Exec("ALTER TABLE web ADD FOREIGN KEY(id) REFERENCES languages(id)")
 		checkError(err, "web")
 
 		//english is the master table, with synonyms and parent ids
 		//in the other language tables every word has an english equivalent
-		r.createTable(tx, "english", &ImportOptions{})
+		counts["english"] = r.createTable(tx, "english", &ImportOptions{})
 
 		_, err = tx.Exec("ALTER TABLE english ADD FOREIGN KEY(synonyms) REFERENCES english(id)")
 		checkError(err, "english")
@@ -378,11 +516,11 @@ func (r *SqlRepo) ResetDB() error {
 		tx.Exec("CREATE INDEX idx ON english(synonyms)")
 		tx.Exec("CREATE INDEX wrd_eng ON english(word)")
 
-		for _, lang := range r.languages {
+		for _, lang := range languages {
 			if lang == "english" {
 				continue
 			}
-			r.createTable(tx, lang, &ImportOptions{AutoId: true})
+			counts[lang] = r.createTable(tx, lang, &ImportOptions{AutoId: true})
 
 			_, err = tx.Exec("ALTER TABLE " + lang +
 				" ADD FOREIGN KEY(english_id) REFERENCES english(id)")
@@ -393,12 +531,13 @@ func (r *SqlRepo) ResetDB() error {
 
 			tx.Exec("CREATE INDEX wrd_" + lang[:3] + " ON " + lang + "(word)")
 		}
+		err = saveMeta(tx, version, now)
+		checkError(err, "meta")
 		return err
 	})
 	if err == nil {
-		r.refreshLanguages()
-		r.refreshLanguageMaps()
-		r.refreshWordsCache()
+		r.setVersion(version, now)
+		err = r.refreshCaches(ctx)
 	}
-	return err
+	return
 }
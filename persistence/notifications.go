@@ -0,0 +1,99 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+// status is pending until the notification is delivered or given up on
+const createNotificationsTable = "CREATE TABLE IF NOT EXISTS notifications (" +
+	"id SERIAL PRIMARY KEY, " +
+	"event VARCHAR(64) NOT NULL, " +
+	"channel VARCHAR(32) NOT NULL, " +
+	"subject VARCHAR(255) NOT NULL, " +
+	"body TEXT NOT NULL, " +
+	"format VARCHAR(16) NOT NULL DEFAULT 'text', " +
+	"attachment_name VARCHAR(255) NOT NULL DEFAULT '', " +
+	"attachment TEXT NOT NULL DEFAULT '', " +
+	"status VARCHAR(16) NOT NULL DEFAULT 'pending', " +
+	"attempts INT NOT NULL DEFAULT 0, " +
+	"next_attempt TIMESTAMPTZ NOT NULL DEFAULT now(), " +
+	"last_error TEXT, " +
+	"created TIMESTAMPTZ NOT NULL DEFAULT now())"
+
+func (r *SqlRepo) EnqueueNotification(ctx context.Context, n *Notification) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		if n.Format == "" {
+			n.Format = "text"
+		}
+		return tx.QueryRow("INSERT INTO notifications (event, channel, subject, body, format, attachment_name, "+
+			"attachment) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, next_attempt, created",
+			n.Event, n.Channel, n.Subject, n.Body, n.Format, n.AttachmentName, n.Attachment).
+			Scan(&n.Id, &n.NextAttempt, &n.Created)
+	})
+}
+
+// notificationLease is how long the notifications returned by
+// GetDueNotifications are kept from other callers, while they are delivered.
+const notificationLease = "10 minutes"
+
+// GetDueNotifications returns up to limit pending notifications whose next
+// attempt is due, oldest first. They are claimed for a while, so that other
+// instances sharing the queue skip them rather than sending them again.
+func (r *SqlRepo) GetDueNotifications(ctx context.Context, limit int) ([]*Notification, error) {
+	notifications := make([]*Notification, 0)
+	err := r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.Query("UPDATE notifications SET next_attempt=now()+interval '"+notificationLease+"' "+
+			"WHERE id IN (SELECT id FROM notifications WHERE status='pending' AND next_attempt<=now() "+
+			"ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED) RETURNING id, event, channel, subject, body, format, "+
+			"attachment_name, attachment, attempts, next_attempt, last_error, created", limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			n := &Notification{}
+			var lastError sql.NullString
+			err = rows.Scan(&n.Id, &n.Event, &n.Channel, &n.Subject, &n.Body, &n.Format, &n.AttachmentName,
+				&n.Attachment, &n.Attempts, &n.NextAttempt,
+				&lastError, &n.Created)
+			if err != nil {
+				return err
+			}
+			n.LastError = lastError.String
+			notifications = append(notifications, n)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].Id < notifications[j].Id })
+	return notifications, nil
+}
+
+func (r *SqlRepo) MarkNotificationDelivered(ctx context.Context, id int64) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE notifications SET status='delivered', attempts=attempts+1 WHERE id=$1", id)
+		return err
+	})
+}
+
+// MarkNotificationFailed records a failed attempt. The notification is
+// retried at next, unless giveUp is set.
+func (r *SqlRepo) MarkNotificationFailed(ctx context.Context, id int64, lastError string, next time.Time, giveUp bool) error {
+	status := "pending"
+	if giveUp {
+		status = "failed"
+	}
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE notifications SET status=$1, attempts=attempts+1, next_attempt=$2, last_error=$3 "+
+			"WHERE id=$4", status, next, lastError, id)
+		return err
+	})
+}
@@ -1,11 +1,13 @@
 package persistence
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	. "github.com/beppeben/go-dictionary/domain"
 	. "github.com/beppeben/go-dictionary/utils"
 )
@@ -37,36 +39,40 @@ const (
 		"FROM english JOIN toeng ON toeng.syn=english.id OR toeng.enid=english.synonyms) "
 
 	searchWithSynonymsToAny = searchWithSynonymsBase +
-		"SELECT word, description, definition, loc, genre.:lang FROM toeng " +
+		"SELECT toeng.enid, word, description, definition, loc, genre.:lang FROM toeng " +
 		"INNER JOIN :lang ON toeng.enid=:lang.english_id " +
 		"LEFT JOIN genre on :lang.genre=genre.id;"
 
 	searchWithSynonymsToEng = searchWithSynonymsBase +
-		"SELECT word, description, definition, loc, genre.english FROM toeng " +
+		"SELECT toeng.enid, word, description, definition, loc, genre.english FROM toeng " +
 		"INNER JOIN english ON toeng.enid=english.id " +
 		"LEFT JOIN genre on english.genre=genre.id;"
 )
 
-func (r *SqlRepo) GetCalendarEvents(month int, year int) (events []*CalendarEvent, err error) {
-	st := "SELECT * FROM cal_english WHERE " +
-		"EXTRACT(MONTH FROM start_date) = $1 AND EXTRACT(YEAR FROM start_date) = $2 OR " +
-		"EXTRACT(MONTH FROM end_date) = $1 AND EXTRACT(YEAR FROM end_date) = $2;"
+// GetCalendarEvents returns the events overlapping the month, in lang.
+// Recurring events are expanded into their occurrences in the month.
+func (r *SqlRepo) GetCalendarEvents(ctx context.Context, month int, year int, lang string) ([]*CalendarEvent, error) {
+	first := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return r.GetCalendarRange(ctx, &CalendarFilter{From: first, To: first.AddDate(0, 1, -1)}, lang)
+}
 
-	rows, err := r.handler.Conn().Query(st, month, year)
-	if err != nil {
-		return
+// GetCalendarFeed returns the events ending on since or later, in lang and
+// by start date. Only the events with the given tag are returned, unless it
+// is empty. Recurring events are returned once, with their rule, however old
+// their first occurrence.
+func (r *SqlRepo) GetCalendarFeed(ctx context.Context, tag string, since time.Time, lang string) ([]*CalendarEvent, error) {
+	columns, tables := r.calendarQuery(lang)
+	st := "SELECT " + columns + " FROM " + tables + " WHERE (c.end_date >= $1 OR COALESCE(c.recurrence, '') <> '')"
+	args := []interface{}{since}
+	if tag != "" {
+		st += " AND lower(c.tag) = lower($2)"
+		args = append(args, tag)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		event := &CalendarEvent{}
-		err = rows.Scan(&event.Id, &event.StartDate, &event.EndDate, &event.Tag, &event.Title, &event.Description)
-		if err != nil {
-			return
-		}
-		events = append(events, event)
+	rows, err := r.handler.QueryContext(ctx, st+" ORDER BY c.start_date, c.id", args...)
+	if err != nil {
+		return nil, err
 	}
-	return
+	return scanCalendarEvents(rows)
 }
 
 func translationsAndForeignSynonymsStmt(lang1 string, lang2 string) string {
@@ -86,27 +92,30 @@ func translationsAndForeignSynonymsStmt(lang1 string, lang2 string) string {
 	return s
 }
 
-func (r *SqlRepo) queryAndAddToSets(statement string, set1 map[string]bool, set2 map[string]bool) {
-	rows, err := r.handler.Conn().Query(statement)
+func (r *SqlRepo) queryAndAddToSets(ctx context.Context, statement string, set1 map[string]bool, set2 map[string]bool) error {
+	rows, err := r.handler.QueryContext(ctx, statement)
 	if err != nil {
-		return
+		return err
 	}
 	defer rows.Close()
-	var l1, l2 string
+	var l1, l2 sql.NullString
 	for rows.Next() {
-		rows.Scan(&l1, &l2)
-		if l1 != "" {
-			set1[l1] = true
+		if err = rows.Scan(&l1, &l2); err != nil {
+			return err
 		}
-		if l2 != "" {
-			set2[l2] = true
+		if l1.String != "" {
+			set1[l1.String] = true
+		}
+		if l2.String != "" {
+			set2[l2.String] = true
 		}
 	}
+	return rows.Err()
 }
 
-func (r *SqlRepo) GetWordsWithTerm(term string, lang1 string, lang2 string) (words []*SimpleWord, err error) {
+func (r *SqlRepo) GetWordsWithTerm(ctx context.Context, term string, lang1 string, lang2 string) (words []*SimpleWord, err error) {
 	term = MapToASCII(term)
-	words1, words2, err := r.GetWords(lang1, lang2)
+	words1, words2, err := r.GetWords(ctx, lang1, lang2)
 	if err != nil {
 		return nil, err
 	}
@@ -123,20 +132,37 @@ func (r *SqlRepo) GetWordsWithTerm(term string, lang1 string, lang2 string) (wor
 		}
 	}
 	sort.Sort(LeastWordsAlphabeticSimple{Words: words, Term: term, LangFirst: lang1})
+	Logger(ctx).Debugf("%d words matching %q in %s/%s", len(words), term, lang1, lang2)
 	return
 }
 
-func (r *SqlRepo) GetWords(lang1 string, lang2 string) (words1 []*SimpleWord, words2 []*SimpleWord, err error) {
+func (r *SqlRepo) GetWords(ctx context.Context, lang1 string, lang2 string) (words1 []*SimpleWord, words2 []*SimpleWord, err error) {
+	r.cache.RLock()
 	words := r.allWords[lang1+lang2]
+	r.cache.RUnlock()
 	if words != nil {
 		words1 = words.First
 		words2 = words.Second
 		return
 	}
+	words1, words2, err = r.loadWords(ctx, lang1, lang2)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.setWords(lang1, lang2, words1, words2)
+	return
+}
+
+// loadWords reads the words of the dictionary between lang1 and lang2.
+func (r *SqlRepo) loadWords(ctx context.Context, lang1 string, lang2 string) (words1 []*SimpleWord, words2 []*SimpleWord, err error) {
 	set1 := make(map[string]bool)
 	set2 := make(map[string]bool)
-	r.queryAndAddToSets(translationsAndForeignSynonymsStmt(lang1, lang2), set1, set2)
-	r.queryAndAddToSets(translationsAndForeignSynonymsStmt(lang2, lang1), set2, set1)
+	if err = r.queryAndAddToSets(ctx, translationsAndForeignSynonymsStmt(lang1, lang2), set1, set2); err != nil {
+		return
+	}
+	if err = r.queryAndAddToSets(ctx, translationsAndForeignSynonymsStmt(lang2, lang1), set2, set1); err != nil {
+		return
+	}
 	for word, _ := range set1 {
 		words1 = append(words1, &SimpleWord{word, MapToASCII(word), strings.Count(word, " "), lang1[:3]})
 	}
@@ -145,15 +171,33 @@ func (r *SqlRepo) GetWords(lang1 string, lang2 string) (words1 []*SimpleWord, wo
 		words2 = append(words2, &SimpleWord{word, MapToASCII(word), strings.Count(word, " "), lang2[:3]})
 	}
 	sort.Sort(LeastWordsAlphabeticSimple{Words: words2})
+	return
+}
+
+// dropWords forgets the dictionary between lang1 and lang2, so that it is
+// loaded again when needed.
+func (r *SqlRepo) dropWords(lang1 string, lang2 string) {
+	r.cache.Lock()
+	defer r.cache.Unlock()
+	delete(r.allWords, lang1+lang2)
+	delete(r.allWords, lang2+lang1)
+}
+
+// setWords caches the dictionary between lang1 and lang2, both ways.
+func (r *SqlRepo) setWords(lang1 string, lang2 string, words1 []*SimpleWord, words2 []*SimpleWord) {
+	r.cache.Lock()
+	defer r.cache.Unlock()
+	if r.allWords == nil {
+		r.allWords = make(map[string]*SimpleWordsPair)
+	}
 	r.allWords[lang1+lang2] = &SimpleWordsPair{First: words1, Second: words2}
 	r.allWords[lang2+lang1] = &SimpleWordsPair{First: words2, Second: words1}
-	return
 }
 
-func (r *SqlRepo) Search(word, fromLang, toLang, baseLang string) (words []*Word, err error) {
+func (r *SqlRepo) Search(ctx context.Context, word, fromLang, toLang, baseLang string) (words []*Word, err error) {
 	n := len(word)
 	for i := n; i >= n-1; i-- {
-		words, err = r.search(word, fromLang, toLang, baseLang)
+		words, err = r.search(ctx, word, fromLang, toLang, baseLang)
 		if err != nil {
 			word = word[:len(word)-1]
 		} else {
@@ -163,7 +207,7 @@ func (r *SqlRepo) Search(word, fromLang, toLang, baseLang string) (words []*Word
 	return
 }
 
-func (r *SqlRepo) search(word, fromLang, toLang, baseLang string) (words []*Word, err error) {
+func (r *SqlRepo) search(ctx context.Context, word, fromLang, toLang, baseLang string) (words []*Word, err error) {
 	var statement string
 	if fromLang == "english" {
 		statement = "SELECT english.id, description, definition, loc, genre." + fromLang + " FROM english " +
@@ -175,7 +219,7 @@ func (r *SqlRepo) search(word, fromLang, toLang, baseLang string) (words []*Word
 			"WHERE WORD=$1"
 		statement = strings.Replace(statement, ":lang", fromLang, -1)
 	}
-	rows, err := r.handler.Conn().Query(statement, word)
+	rows, err := r.handler.QueryContext(ctx, statement, word)
 	if err != nil {
 		return nil, err
 	}
@@ -185,18 +229,18 @@ func (r *SqlRepo) search(word, fromLang, toLang, baseLang string) (words []*Word
 	var description, definition, loc, genre string
 	for rows.Next() {
 		rows.Scan(&enId, &description, &definition, &loc, &genre)
-		lang := &Language{Language: r.langMatrix[fromLang[:3]+baseLang[:3]], Tag: fromLang[:3]}
-		w := &Word{Word: word, Description: description, Definition: definition,
+		lang := &Language{Language: r.langName(fromLang[:3], baseLang[:3]), Tag: fromLang[:3]}
+		w := &Word{Id: enId, Word: word, Description: description, Definition: definition,
 			Locality: loc, Lang: lang, Genre: genre}
-		translations, err := r.translate(w, toLang, baseLang, enId)
+		translations, err := r.translate(ctx, w, toLang, baseLang, enId)
 		if err != nil {
-			log.Infoln(err.Error())
+			Logger(ctx).Infoln(err.Error())
 			return nil, err
 		}
 		w.Translations = translations
-		synonyms, err := r.translate(w, fromLang, baseLang, enId)
+		synonyms, err := r.translate(ctx, w, fromLang, baseLang, enId)
 		if err != nil {
-			log.Infoln(err.Error())
+			Logger(ctx).Infoln(err.Error())
 			return nil, err
 		}
 		w.Synonyms = synonyms
@@ -204,9 +248,9 @@ func (r *SqlRepo) search(word, fromLang, toLang, baseLang string) (words []*Word
 		statement = "SELECT fields." + baseLang + ", fields_expl." + baseLang + " FROM english " +
 			"INNER JOIN fields on english.field=fields.id " +
 			"INNER JOIN fields_expl ON fields.id=fields_expl.id WHERE english.id=$1"
-		frows, err := r.handler.Conn().Query(statement, enId)
+		frows, err := r.handler.QueryContext(ctx, statement, enId)
 		if err != nil {
-			log.Infoln(err.Error())
+			Logger(ctx).Infoln(err.Error())
 			return nil, err
 		}
 		defer frows.Close()
@@ -224,24 +268,25 @@ func (r *SqlRepo) search(word, fromLang, toLang, baseLang string) (words []*Word
 	return words, nil
 }
 
-func (r *SqlRepo) translate(word *Word, toLang string, baseLang string, enId int64) (words []*Word, err error) {
+func (r *SqlRepo) translate(ctx context.Context, word *Word, toLang string, baseLang string, enId int64) (words []*Word, err error) {
 	var statement string
 	if toLang == "english" {
 		statement = searchWithSynonymsToEng
 	} else {
 		statement = strings.Replace(searchWithSynonymsToAny, ":lang", toLang, -1)
 	}
-	rows, err := r.handler.Conn().Query(statement, enId)
+	rows, err := r.handler.QueryContext(ctx, statement, enId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	var id int64
 	var wrd, description, definition, loc, genre string
 	for rows.Next() {
-		rows.Scan(&wrd, &description, &definition, &loc, &genre)
+		rows.Scan(&id, &wrd, &description, &definition, &loc, &genre)
 		if word.Word != wrd || word.Lang.Tag != toLang[:3] {
-			lang := &Language{Language: r.langMatrix[toLang[:3]+baseLang[:3]], Tag: toLang[:3]}
-			w := &Word{Word: wrd, Description: description, Definition: definition,
+			lang := &Language{Language: r.langName(toLang[:3], baseLang[:3]), Tag: toLang[:3]}
+			w := &Word{Id: id, Word: wrd, Description: description, Definition: definition,
 				Locality: loc, Lang: lang, Genre: genre}
 			words = append(words, w)
 		}
@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"database/sql"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const createRateEventsTable = "CREATE TABLE IF NOT EXISTS rate_events (" +
+	"kind VARCHAR(32) NOT NULL, " +
+	"ip VARCHAR(64) NOT NULL, " +
+	"time TIMESTAMPTZ NOT NULL DEFAULT now())"
+
+const createRateEventsIndex = "CREATE INDEX IF NOT EXISTS rate_events_ip ON rate_events (kind, ip, time)"
+
+// rateEventsKept is how long rate events are kept, longer than any window
+// they are counted in.
+const rateEventsKept = 24 * time.Hour
+
+// takeRate records an action of the given kind from ip in tx, or returns
+// ErrRateLimited if ip already made limit of them since. Concurrent calls for
+// the same kind and ip wait for each other until tx ends, so that they cannot
+// all pass the count.
+func takeRate(tx *sql.Tx, kind, ip string, limit int, since time.Time) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", kind+" "+ip); err != nil {
+		return err
+	}
+	var count int
+	err := tx.QueryRow("SELECT count(*) FROM rate_events WHERE kind=$1 AND ip=$2 AND time>$3",
+		kind, ip, since).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= limit {
+		return ErrRateLimited
+	}
+	_, err = tx.Exec("INSERT INTO rate_events (kind, ip) VALUES ($1, $2)", kind, ip)
+	return err
+}
@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+)
+
+// adminTables hold data managed by the application itself rather than
+// imported from the workbook, so ResetDB never drops them.
+var adminTables = []string{
+	createUsersTable,
+	createTokensTable,
+	createAuditTable,
+	createSuggestionsTable,
+	createFeedbackTable,
+	createRateEventsTable,
+	createRateEventsIndex,
+	createNotificationsTable,
+	createSearchStatsTable,
+	createVisitStatsTable,
+	createCounterStatsTable,
+}
+
+func (r *SqlRepo) createAdminTables(ctx context.Context) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		for _, st := range adminTables {
+			if _, err := tx.Exec(st); err != nil {
+				return err
+			}
+		}
+		var calendar bool
+		if err := tx.QueryRow("SELECT to_regclass('cal_english') IS NOT NULL").Scan(&calendar); err != nil {
+			return err
+		}
+		if calendar {
+			return upgradeCalendarTable(tx)
+		}
+		return nil
+	})
+}
@@ -1,10 +1,15 @@
 package persistence
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"runtime"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/beppeben/go-dictionary/utils"
 	_ "github.com/lib/pq"
 )
 
@@ -12,33 +17,116 @@ type MySqlConfig interface {
 	GetUserDB() string
 	GetPassDB() string
 	GetDBName() string
+	GetDBHost() string
+	GetDBPort() int
+	GetDBSSLMode() string
+	GetDBSSLRootCert() string
+	GetDBMaxOpenConns() int
+	GetDBMaxIdleConns() int
+	GetDBConnMaxLifetime() time.Duration
+	GetSlowQueryThreshold() time.Duration
 }
 
 type MySqlHandler struct {
 	Connection *sql.DB
+	slowQuery  time.Duration
 }
 
-func NewMySqlHandler(c MySqlConfig) *MySqlHandler {
-	info := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", c.GetUserDB(), c.GetPassDB(), c.GetDBName())
-	conn, err := sql.Open("postgres", info)
+func NewMySqlHandler(c MySqlConfig) (*MySqlHandler, error) {
+	conn, err := sql.Open("postgres", connectionString(c))
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
+	conn.SetMaxOpenConns(c.GetDBMaxOpenConns())
+	conn.SetMaxIdleConns(c.GetDBMaxIdleConns())
+	conn.SetConnMaxLifetime(c.GetDBConnMaxLifetime())
 	err = conn.Ping()
 	if err != nil {
-		panic(err.Error())
-	} else {
-		log.Infoln("Established connection with database")
+		conn.Close()
+		return nil, err
 	}
-	return &MySqlHandler{Connection: conn}
+	log.Infoln("Established connection with database")
+	return &MySqlHandler{Connection: conn, slowQuery: c.GetSlowQueryThreshold()}, nil
 }
 
-func (handler *MySqlHandler) Conn() *sql.DB {
-	return handler.Connection
+func connectionString(c MySqlConfig) string {
+	params := []string{
+		"user=" + quoteParam(c.GetUserDB()),
+		"password=" + quoteParam(c.GetPassDB()),
+		"dbname=" + quoteParam(c.GetDBName()),
+		"host=" + quoteParam(c.GetDBHost()),
+		fmt.Sprintf("port=%d", c.GetDBPort()),
+		"sslmode=" + quoteParam(c.GetDBSSLMode()),
+	}
+	if c.GetDBSSLRootCert() != "" {
+		params = append(params, "sslrootcert="+quoteParam(c.GetDBSSLRootCert()))
+	}
+	return strings.Join(params, " ")
+}
+
+// quoteParam quotes a value for a key=value connection string, so that
+// passwords with spaces or quotes survive.
+func quoteParam(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// QueryContext runs a statement that is cancelled when ctx is done, logging
+// it with the request-scoped logger of ctx when it is slower than the
+// configured threshold. Only the time until the first row is measured: the
+// rows are read by the caller, after this returns.
+func (handler *MySqlHandler) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	t1 := time.Now()
+	rows, err := handler.Connection.QueryContext(ctx, query, args...)
+	if d := time.Since(t1); handler.slowQuery > 0 && d > handler.slowQuery {
+		utils.Logger(ctx).WithField("duration", d).Warnf("Slow query: %s", query)
+	}
+	return rows, err
+}
+
+func (handler *MySqlHandler) Ping(ctx context.Context) error {
+	return handler.Connection.PingContext(ctx)
+}
+
+func (handler *MySqlHandler) Stats() sql.DBStats {
+	return handler.Connection.Stats()
+}
+
+func (handler *MySqlHandler) Close() error {
+	log.Infoln("Closing connection with database")
+	return handler.Connection.Close()
 }
 
-func (handler *MySqlHandler) Transact(txFunc func(*sql.Tx) (interface{}, error)) (obj interface{}, err error) {
-	tx, err := handler.Connection.Begin()
+// transactionCaller names the function that started a transaction, for the
+// slow transaction log.
+func transactionCaller() string {
+	for skip := 2; ; skip++ {
+		pc, file, _, ok := runtime.Caller(skip)
+		if !ok {
+			return "unknown"
+		}
+		name := runtime.FuncForPC(pc).Name()
+		// deferred calls run below the runtime frames of a panic
+		if !strings.HasSuffix(file, "/sqlhandler.go") && !strings.HasPrefix(name, "runtime.") {
+			return name
+		}
+	}
+}
+
+// Transact runs txFunc in a transaction bound to ctx. If ctx has a deadline,
+// it is also set as the statement_timeout of the transaction, so that
+// Postgres cancels long statements on its side. Transactions slower than the
+// configured threshold are logged with the function that started them, as
+// their statements are not timed one by one.
+func (handler *MySqlHandler) Transact(ctx context.Context, txFunc func(*sql.Tx) (interface{}, error)) (obj interface{}, err error) {
+	t1 := time.Now()
+	defer func() {
+		if d := time.Since(t1); handler.slowQuery > 0 && d > handler.slowQuery {
+			utils.Logger(ctx).WithField("duration", d).Warnf("Slow transaction in %s", transactionCaller())
+		}
+	}()
+	tx, err := handler.Connection.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -52,19 +140,29 @@ func (handler *MySqlHandler) Transact(txFunc func(*sql.Tx) (interface{}, error))
 			}
 		}
 		if err != nil {
-			log.Infoln("Rolling back")
+			utils.Logger(ctx).Infoln("Rolling back")
 			tx.Rollback()
 			return
 		}
 		err = tx.Commit()
 	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline) / time.Millisecond
+		if timeout < 1 {
+			timeout = 1
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout))
+		if err != nil {
+			return
+		}
+	}
 	return txFunc(tx)
 }
 
-func (handler *MySqlHandler) TransactNoRet(txFunc func(*sql.Tx) error) error {
+func (handler *MySqlHandler) TransactNoRet(ctx context.Context, txFunc func(*sql.Tx) error) error {
 	f := func(tx *sql.Tx) (interface{}, error) {
 		return nil, txFunc(tx)
 	}
-	_, err := handler.Transact(f)
+	_, err := handler.Transact(ctx, f)
 	return err
 }
@@ -0,0 +1,202 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const createSearchStatsTable = "CREATE TABLE IF NOT EXISTS search_stats (" +
+	"day DATE NOT NULL, " +
+	"lang_pair CHAR(6) NOT NULL, " +
+	"term VARCHAR(255) NOT NULL, " +
+	"found BOOLEAN NOT NULL, " +
+	"hits INT NOT NULL, " +
+	"PRIMARY KEY (day, lang_pair, term, found))"
+
+const createVisitStatsTable = "CREATE TABLE IF NOT EXISTS visit_stats (" +
+	"day DATE NOT NULL, " +
+	"visitor CHAR(64) NOT NULL, " +
+	"ip VARCHAR(64) NOT NULL, " +
+	"city VARCHAR(255) NOT NULL, " +
+	"region VARCHAR(255) NOT NULL, " +
+	"country VARCHAR(64) NOT NULL, " +
+	"user_agent TEXT NOT NULL, " +
+	"referer TEXT NOT NULL, " +
+	"last_uri TEXT NOT NULL, " +
+	"hits INT NOT NULL, " +
+	"PRIMARY KEY (day, visitor))"
+
+const createCounterStatsTable = "CREATE TABLE IF NOT EXISTS counter_stats (" +
+	"day DATE NOT NULL, " +
+	"name VARCHAR(32) NOT NULL, " +
+	"key VARCHAR(255) NOT NULL, " +
+	"hits INT NOT NULL, " +
+	"PRIMARY KEY (day, name, key))"
+
+// SaveStats adds the hits of searches, visits and counters to the stored aggregates.
+func (r *SqlRepo) SaveStats(ctx context.Context, searches []*SearchStat, visits []*VisitStat, counters []*CounterStat) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		for _, c := range counters {
+			_, err := tx.Exec("INSERT INTO counter_stats (day, name, key, hits) VALUES ($1, $2, $3, $4) "+
+				"ON CONFLICT (day, name, key) DO UPDATE SET hits=counter_stats.hits+EXCLUDED.hits",
+				c.Day, c.Name, c.Key, c.Hits)
+			if err != nil {
+				return err
+			}
+		}
+		for _, s := range searches {
+			_, err := tx.Exec("INSERT INTO search_stats (day, lang_pair, term, found, hits) VALUES ($1, $2, $3, $4, $5) "+
+				"ON CONFLICT (day, lang_pair, term, found) DO UPDATE SET hits=search_stats.hits+EXCLUDED.hits",
+				s.Day, s.LangPair, s.Term, s.Found, s.Hits)
+			if err != nil {
+				return err
+			}
+		}
+		for _, v := range visits {
+			_, err := tx.Exec("INSERT INTO visit_stats (day, visitor, ip, city, region, country, user_agent, referer, "+
+				"last_uri, hits) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) "+
+				"ON CONFLICT (day, visitor) DO UPDATE SET hits=visit_stats.hits+EXCLUDED.hits, "+
+				"last_uri=EXCLUDED.last_uri, city=COALESCE(NULLIF(EXCLUDED.city, ''), visit_stats.city), "+
+				"region=COALESCE(NULLIF(EXCLUDED.region, ''), visit_stats.region), "+
+				"country=COALESCE(NULLIF(EXCLUDED.country, ''), visit_stats.country)",
+				v.Day, v.Visitor, v.Ip, v.City, v.Region, v.Country, v.UserAgent, v.Referer, v.LastUri, v.Hits)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetSearchStats sums the searches between the days from and to, both
+// included, the most searched first. All of them are returned if limit is 0.
+func (r *SqlRepo) GetSearchStats(ctx context.Context, from, to time.Time, limit int) ([]*SearchStat, error) {
+	query := "SELECT lang_pair, term, found, sum(hits) AS total FROM search_stats WHERE day>=$1 AND day<=$2 " +
+		"GROUP BY lang_pair, term, found ORDER BY total DESC, term"
+	args := []interface{}{from, to}
+	if limit > 0 {
+		query += " LIMIT $3"
+		args = append(args, limit)
+	}
+	rows, err := r.handler.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make([]*SearchStat, 0)
+	for rows.Next() {
+		s := &SearchStat{}
+		if err = rows.Scan(&s.LangPair, &s.Term, &s.Found, &s.Hits); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// GetVisitStats returns the visits between the days from and to, both
+// included, by day and number of hits.
+func (r *SqlRepo) GetVisitStats(ctx context.Context, from, to time.Time) ([]*VisitStat, error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT day, visitor, ip, city, region, country, user_agent, referer, "+
+		"last_uri, hits FROM visit_stats WHERE day>=$1 AND day<=$2 ORDER BY day, hits DESC", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make([]*VisitStat, 0)
+	for rows.Next() {
+		v := &VisitStat{}
+		err = rows.Scan(&v.Day, &v.Visitor, &v.Ip, &v.City, &v.Region, &v.Country, &v.UserAgent, &v.Referer,
+			&v.LastUri, &v.Hits)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, v)
+	}
+	return stats, rows.Err()
+}
+
+// GetTopSearches returns, for every language pair, the perPair most searched
+// terms between the days from and to, both included, that were found or not.
+func (r *SqlRepo) GetTopSearches(ctx context.Context, from, to time.Time, found bool, perPair int) ([]*SearchStat, error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT lang_pair, term, total FROM ("+
+		"SELECT lang_pair, term, sum(hits) AS total, "+
+		"row_number() OVER (PARTITION BY lang_pair ORDER BY sum(hits) DESC, term) AS rank "+
+		"FROM search_stats WHERE day>=$1 AND day<=$2 AND found=$3 GROUP BY lang_pair, term) AS ranked "+
+		"WHERE rank<=$4 ORDER BY lang_pair, rank", from, to, found, perPair)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make([]*SearchStat, 0)
+	for rows.Next() {
+		s := &SearchStat{Found: found}
+		if err = rows.Scan(&s.LangPair, &s.Term, &s.Hits); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// GetSearchTotals sums the searches between the days from and to, both
+// included, per language pair.
+func (r *SqlRepo) GetSearchTotals(ctx context.Context, from, to time.Time) (map[string]int, error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT lang_pair, sum(hits) FROM search_stats "+
+		"WHERE day>=$1 AND day<=$2 GROUP BY lang_pair", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanTotals(rows)
+}
+
+// GetCounterTotals sums the counter name between the days from and to, both
+// included, per key.
+func (r *SqlRepo) GetCounterTotals(ctx context.Context, name string, from, to time.Time) (map[string]int, error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT key, sum(hits) FROM counter_stats "+
+		"WHERE name=$1 AND day>=$2 AND day<=$3 GROUP BY key", name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanTotals(rows)
+}
+
+func scanTotals(rows *sql.Rows) (map[string]int, error) {
+	totals := make(map[string]int)
+	var key string
+	var total int
+	for rows.Next() {
+		if err := rows.Scan(&key, &total); err != nil {
+			return nil, err
+		}
+		totals[key] = total
+	}
+	return totals, rows.Err()
+}
+
+// PurgeStats deletes the stats of the days before the given one, and forgets
+// the addresses of the feedback sent before it, as well as the notifications
+// created before it that were delivered or given up on. Rate events are only
+// kept for a day.
+func (r *SqlRepo) PurgeStats(ctx context.Context, before time.Time) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"search_stats", "visit_stats", "counter_stats"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE day<$1", before); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE feedback SET ip='' WHERE created<$1 AND ip<>''", before); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM notifications WHERE created<$1 AND status<>'pending'", before); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM rate_events WHERE time<$1", time.Now().Add(-rateEventsKept))
+		return err
+	})
+}
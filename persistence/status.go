@@ -0,0 +1,118 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	. "github.com/beppeben/go-dictionary/utils"
+)
+
+const (
+	metaVersion    = "dictionary_version"
+	metaLastImport = "last_import"
+)
+
+type repoStatus struct {
+	sync.RWMutex
+	ready       bool
+	importing   bool
+	version     string
+	lastImport  time.Time
+	cachedWords int
+}
+
+func (r *SqlRepo) Ping(ctx context.Context) error {
+	return r.handler.Ping(ctx)
+}
+
+// GetStatus tells whether the caches are built and an import is running,
+// along with the version of the imported workbook.
+func (r *SqlRepo) GetStatus(ctx context.Context) *DictionaryStatus {
+	languages := r.getLanguages()
+	r.status.RLock()
+	defer r.status.RUnlock()
+	return &DictionaryStatus{Ready: r.status.ready, Importing: r.status.importing,
+		Version: r.status.version, LastImport: r.status.lastImport, Languages: len(languages)}
+}
+
+func (r *SqlRepo) GetDBStats(ctx context.Context) sql.DBStats {
+	return r.handler.Stats()
+}
+
+// GetCachedWordsCount returns the number of words in the autocomplete cache.
+// Every dictionary is cached in both directions, so each pair is counted once.
+func (r *SqlRepo) GetCachedWordsCount(ctx context.Context) int {
+	r.status.RLock()
+	defer r.status.RUnlock()
+	return r.status.cachedWords
+}
+
+func (r *SqlRepo) setReady(ready bool) {
+	count := 0
+	if ready {
+		r.cache.RLock()
+		for i := 1; i < len(r.languages); i++ {
+			for j := 0; j < i; j++ {
+				if words := r.allWords[r.languages[i]+r.languages[j]]; words != nil {
+					count += len(words.First) + len(words.Second)
+				}
+			}
+		}
+		r.cache.RUnlock()
+	}
+	r.status.Lock()
+	r.status.ready = ready
+	r.status.cachedWords = count
+	r.status.Unlock()
+}
+
+func (r *SqlRepo) setImporting(importing bool) {
+	r.status.Lock()
+	r.status.importing = importing
+	r.status.Unlock()
+}
+
+func (r *SqlRepo) setVersion(version string, lastImport time.Time) {
+	r.status.Lock()
+	r.status.version = version
+	r.status.lastImport = lastImport
+	r.status.Unlock()
+}
+
+// loadMeta reads the version of the last imported workbook, if any.
+func (r *SqlRepo) loadMeta(ctx context.Context) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT key, value FROM meta")
+	if err != nil {
+		Logger(ctx).Debugf("No import metadata: %v", err)
+		return
+	}
+	defer rows.Close()
+	var key, value, version string
+	var lastImport time.Time
+	for rows.Next() {
+		rows.Scan(&key, &value)
+		switch key {
+		case metaVersion:
+			version = value
+		case metaLastImport:
+			lastImport, _ = time.Parse(time.RFC3339, value)
+		}
+	}
+	r.setVersion(version, lastImport)
+}
+
+func saveMeta(tx *sql.Tx, version string, lastImport time.Time) error {
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS meta (key VARCHAR(255) PRIMARY KEY, value VARCHAR(255))")
+	if err != nil {
+		return err
+	}
+	st := "INSERT INTO meta (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value"
+	if _, err = tx.Exec(st, metaVersion, version); err != nil {
+		return err
+	}
+	_, err = tx.Exec(st, metaLastImport, lastImport.Format(time.RFC3339))
+	return err
+}
@@ -0,0 +1,83 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const createSuggestionsTable = "CREATE TABLE IF NOT EXISTS suggestions (" +
+	"id SERIAL PRIMARY KEY, " +
+	"word VARCHAR(255) NOT NULL, " +
+	"from_lang VARCHAR(64) NOT NULL, " +
+	"to_lang VARCHAR(64) NOT NULL, " +
+	"count INT NOT NULL DEFAULT 1, " +
+	"first_seen TIMESTAMP NOT NULL DEFAULT now(), " +
+	"last_seen TIMESTAMP NOT NULL DEFAULT now(), " +
+	"status VARCHAR(16) NOT NULL DEFAULT 'pending', " +
+	"UNIQUE (word, from_lang, to_lang))"
+
+const selectSuggestions = "SELECT id, word, from_lang, to_lang, count, first_seen, last_seen, status FROM suggestions"
+
+// AddSuggestion stores a suggestion, or counts it again if the same word was
+// already suggested for the same dictionary. A moderated suggestion keeps
+// its status. ip can make perHour suggestions per hour, then ErrRateLimited
+// is returned.
+func (r *SqlRepo) AddSuggestion(ctx context.Context, word, fromLang, toLang, ip string, perHour int) (*Suggestion, error) {
+	s := &Suggestion{}
+	err := r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		if err := takeRate(tx, "suggestion", ip, perHour, time.Now().Add(-time.Hour)); err != nil {
+			return err
+		}
+		return tx.QueryRow("INSERT INTO suggestions (word, from_lang, to_lang) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (word, from_lang, to_lang) DO UPDATE SET count=suggestions.count+1, last_seen=now() "+
+			"RETURNING id, word, from_lang, to_lang, count, first_seen, last_seen, status",
+			word, fromLang, toLang).Scan(&s.Id, &s.Word, &s.FromLang, &s.ToLang, &s.Count,
+			&s.FirstSeen, &s.LastSeen, &s.Status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSuggestions returns the suggestions with the given status, or all of
+// them if status is empty, the most requested first.
+func (r *SqlRepo) GetSuggestions(ctx context.Context, status string) ([]*Suggestion, error) {
+	order := " ORDER BY count DESC, last_seen DESC"
+	var rows *sql.Rows
+	var err error
+	if status == "" {
+		rows, err = r.handler.QueryContext(ctx, selectSuggestions+order)
+	} else {
+		rows, err = r.handler.QueryContext(ctx, selectSuggestions+" WHERE status=$1"+order, status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	suggestions := make([]*Suggestion, 0)
+	for rows.Next() {
+		s := &Suggestion{}
+		err = rows.Scan(&s.Id, &s.Word, &s.FromLang, &s.ToLang, &s.Count, &s.FirstSeen, &s.LastSeen, &s.Status)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
+
+func (r *SqlRepo) SetSuggestionStatus(ctx context.Context, id int64, status string) error {
+	if status != SuggestionPending && status != SuggestionAdded && status != SuggestionRejected {
+		return fmt.Errorf("Unknown suggestion status %s", status)
+	}
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE suggestions SET status=$1 WHERE id=$2", status, id)
+		return checkAffected(res, err, "suggestion "+strconv.FormatInt(id, 10))
+	})
+}
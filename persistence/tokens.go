@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const createTokensTable = "CREATE TABLE IF NOT EXISTS api_tokens (" +
+	"id SERIAL PRIMARY KEY, " +
+	"name VARCHAR(255) NOT NULL, " +
+	"token_hash CHAR(64) NOT NULL UNIQUE, " +
+	"permissions VARCHAR(255) NOT NULL, " +
+	"expires TIMESTAMPTZ NOT NULL, " +
+	"created_by VARCHAR(255) NOT NULL, " +
+	"created TIMESTAMPTZ NOT NULL DEFAULT now(), " +
+	"revoked BOOLEAN NOT NULL DEFAULT false)"
+
+const selectTokens = "SELECT id, name, permissions, expires, created_by, created, revoked FROM api_tokens"
+
+// CreateToken stores a token given the hash of its secret, and sets its id.
+func (r *SqlRepo) CreateToken(ctx context.Context, token *ApiToken, hash string) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		return tx.QueryRow("INSERT INTO api_tokens (name, token_hash, permissions, expires, created_by) "+
+			"VALUES ($1, $2, $3, $4, $5) RETURNING id, created", token.Name, hash,
+			joinPermissions(token.Permissions), token.Expires, token.CreatedBy).Scan(&token.Id, &token.Created)
+	})
+}
+
+// GetTokenByHash returns the token with the given hash, or nil if there is none.
+func (r *SqlRepo) GetTokenByHash(ctx context.Context, hash string) (*ApiToken, error) {
+	rows, err := r.handler.QueryContext(ctx, selectTokens+" WHERE token_hash=$1", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens, err := scanTokens(rows)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	return tokens[0], nil
+}
+
+func (r *SqlRepo) ListTokens(ctx context.Context) ([]*ApiToken, error) {
+	rows, err := r.handler.QueryContext(ctx, selectTokens+" ORDER BY created DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanTokens(rows)
+}
+
+func (r *SqlRepo) RevokeToken(ctx context.Context, id int64) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE api_tokens SET revoked=true WHERE id=$1", id)
+		return checkAffected(res, err, "token "+strconv.FormatInt(id, 10))
+	})
+}
+
+func scanTokens(rows *sql.Rows) ([]*ApiToken, error) {
+	tokens := make([]*ApiToken, 0)
+	for rows.Next() {
+		token := &ApiToken{}
+		var perms string
+		err := rows.Scan(&token.Id, &token.Name, &perms, &token.Expires, &token.CreatedBy,
+			&token.Created, &token.Revoked)
+		if err != nil {
+			return nil, err
+		}
+		token.Permissions = make([]Permission, 0)
+		for _, p := range strings.Split(perms, ",") {
+			if p != "" {
+				token.Permissions = append(token.Permissions, Permission(p))
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func joinPermissions(perms []Permission) string {
+	s := make([]string, len(perms))
+	for i, p := range perms {
+		s[i] = string(p)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,105 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const createUsersTable = "CREATE TABLE IF NOT EXISTS admin_users (" +
+	"username VARCHAR(255) PRIMARY KEY, " +
+	"password_hash VARCHAR(255) NOT NULL, " +
+	"role VARCHAR(32) NOT NULL, " +
+	"created TIMESTAMP NOT NULL DEFAULT now())"
+
+func (r *SqlRepo) CreateUser(ctx context.Context, user *AdminUser) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO admin_users (username, password_hash, role) VALUES ($1, $2, $3)",
+			user.Username, user.PasswordHash, string(user.Role))
+		return err
+	})
+}
+
+// GetUser returns the user with the given name, or nil if there is none.
+func (r *SqlRepo) GetUser(ctx context.Context, username string) (*AdminUser, error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT username, password_hash, role, created "+
+		"FROM admin_users WHERE username=$1", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users, err := scanUsers(rows)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+func (r *SqlRepo) ListUsers(ctx context.Context) ([]*AdminUser, error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT username, password_hash, role, created "+
+		"FROM admin_users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+func (r *SqlRepo) CountUsers(ctx context.Context) (count int, err error) {
+	rows, err := r.handler.QueryContext(ctx, "SELECT count(*) FROM admin_users")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&count)
+	}
+	return
+}
+
+// UpdateUser changes the password hash and role of an existing user.
+func (r *SqlRepo) UpdateUser(ctx context.Context, user *AdminUser) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE admin_users SET password_hash=$1, role=$2 WHERE username=$3",
+			user.PasswordHash, string(user.Role), user.Username)
+		return checkAffected(res, err, "user "+user.Username)
+	})
+}
+
+func (r *SqlRepo) DeleteUser(ctx context.Context, username string) error {
+	return r.handler.TransactNoRet(ctx, func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM admin_users WHERE username=$1", username)
+		return checkAffected(res, err, "user "+username)
+	})
+}
+
+func scanUsers(rows *sql.Rows) ([]*AdminUser, error) {
+	users := make([]*AdminUser, 0)
+	for rows.Next() {
+		user := &AdminUser{}
+		var role string
+		err := rows.Scan(&user.Username, &user.PasswordHash, &role, &user.Created)
+		if err != nil {
+			return nil, err
+		}
+		user.Role = Role(role)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func checkAffected(res sql.Result, err error, what string) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("No such %s", what)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package persistence
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/beppeben/go-dictionary/excel"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+// ValidateWorkbook checks that a dictionary workbook contains all the sheets
+// and columns expected by ResetDB, without touching the database.
+// It returns every problem found, or nil if the workbook can be imported.
+func ValidateWorkbook(reader *excel.ExcelReader) (problems []error) {
+	if err := reader.RefreshFile(); err != nil {
+		return []error{err}
+	}
+	matrices := make(map[string][][]string)
+	get := func(title string) [][]string {
+		if matrix, ok := matrices[title]; ok {
+			return matrix
+		}
+		matrix, err := reader.GetMatrix(title)
+		if err == nil && len(matrix) < 2 {
+			err = fmt.Errorf("Table %s has no rows", title)
+		}
+		if err != nil {
+			problems = append(problems, err)
+			matrix = nil
+		}
+		matrices[title] = matrix
+		return matrix
+	}
+
+	langMatrix := get("languages")
+	if langMatrix == nil {
+		return
+	}
+	if err := checkSquare("languages", langMatrix); err != nil {
+		problems = append(problems, err)
+	}
+	languages := make([]string, 0)
+	for _, row := range langMatrix[1:] {
+		languages = append(languages, strings.ToLower(row[0]))
+	}
+	if !utils.Contains(languages, "english") {
+		problems = append(problems, fmt.Errorf("Table languages must contain english"))
+	}
+
+	for _, title := range []string{"fields", "fields_expl", "genre"} {
+		if matrix := get(title); matrix != nil {
+			if err := checkLanguageHeaders(title, matrix[0][1:], languages); err != nil {
+				problems = append(problems, err)
+			}
+		}
+	}
+	get("web")
+
+	english := get("english")
+	ids := make(map[string]bool)
+	if english != nil {
+		if err := checkColumns("english", english[0], "id", "word"); err != nil {
+			problems = append(problems, err)
+		} else if col := columnIndex(english[0], "id"); col != 0 {
+			// ResetDB keys the table on its first column
+			problems = append(problems, fmt.Errorf("Table english must start with its id column"))
+		} else {
+			for i, row := range english[1:] {
+				if ids[row[col]] {
+					problems = append(problems, fmt.Errorf("Duplicate id %s in table english (row %d)", row[col], i+2))
+				}
+				ids[row[col]] = true
+			}
+		}
+	}
+
+	for _, lang := range languages {
+		if lang == "english" {
+			continue
+		}
+		matrix := get(lang)
+		if matrix == nil {
+			continue
+		}
+		if err := checkColumns(lang, matrix[0], "english_id", "word"); err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		// the ids of the translation tables are generated on import
+		if columnIndex(matrix[0], "id") >= 0 {
+			problems = append(problems, fmt.Errorf("Table %s must not have an id column", lang))
+			continue
+		}
+		if english == nil {
+			continue
+		}
+		col := columnIndex(matrix[0], "english_id")
+		for i, row := range matrix[1:] {
+			if !ids[row[col]] {
+				problems = append(problems, fmt.Errorf("Table %s (row %d) refers to missing english id %q", lang, i+2, row[col]))
+			}
+		}
+	}
+	return
+}
+
+func checkColumns(title string, headers []string, columns ...string) error {
+	for _, column := range columns {
+		if columnIndex(headers, column) < 0 {
+			return fmt.Errorf("Table %s has no %s column", title, column)
+		}
+	}
+	return nil
+}
+
+func columnIndex(headers []string, column string) int {
+	for i, header := range headers {
+		if strings.ToLower(header) == column {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,28 +1,132 @@
 package utils
 
 import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// Every configuration key can be overridden by an environment variable
+// named EnvPrefix + "_" + key, e.g. DICTIONARY_DB_HOST.
+const EnvPrefix = "DICTIONARY"
+
 type AppConfig struct {
 	v *viper.Viper
 }
 
+// configKeys lists the keys exposed as command-line flags, with their defaults.
+// Flag names are the lowercase keys with dashes, e.g. --db-host.
+var configKeys = []struct {
+	key   string
+	value interface{}
+	usage string
+}{
+	{"DB_NAME", "", "database name"},
+	{"DB_USER", "", "database user"},
+	{"DB_PASS", "", "database password"},
+	{"DB_HOST", "localhost", "database host"},
+	{"DB_PORT", 5432, "database port"},
+	{"DB_SSLMODE", "disable", "postgres sslmode (disable, require, verify-ca, verify-full)"},
+	{"DB_SSLROOTCERT", "", "path to the root certificates used to verify the database server"},
+	{"DB_MAX_OPEN_CONNS", 0, "maximum number of open database connections (0 is unlimited)"},
+	{"DB_MAX_IDLE_CONNS", 2, "maximum number of idle database connections"},
+	{"DB_CONN_MAX_LIFETIME", time.Duration(0), "maximum lifetime of a database connection (0 is unlimited)"},
+	{"ADMIN_PASS", "", "admin password"},
+	{"HTTP_DIR", "", "directory served by the web server"},
+	{"SERVER_PORT", "8080", "port the web server listens on"},
+	{"EMAIL", "", "service email address"},
+	{"EMAIL_PASS", "", "service email password"},
+	{"SMTP", "", "smtp server"},
+	{"SMTP_PORT", "", "smtp port"},
+	{"ADMIN_EMAILS", []string{}, "admin email addresses"},
+	{"SLACK_HOOK", "", "slack webhook url"},
+	{"WEBHOOK_URL", "", "url receiving notifications as JSON"},
+	{"NOTIFY_DAILY_REPORT", []string{"slack"}, "channels (slack, email, webhook) receiving the daily report"},
+	{"NOTIFY_SUGGESTION", []string{"slack"}, "channels receiving new word suggestions"},
+	{"NOTIFY_IMPORT", []string{"slack"}, "channels receiving the result of database and calendar imports"},
+	{"LOG_FORMAT", "text", "log output format (text or json)"},
+	{"LOG_LEVEL", "debug", "minimum log level"},
+	{"SLOW_QUERY_THRESHOLD", 200 * time.Millisecond, "log SQL statements slower than this"},
+	{"SEARCH_TIMEOUT", 5 * time.Second, "timeout of a dictionary search"},
+	{"AUTOCOMPLETE_TIMEOUT", 2 * time.Second, "timeout of an autocomplete lookup"},
+	{"CALENDAR_TIMEOUT", 5 * time.Second, "timeout of a calendar query"},
+	{"IMPORT_TIMEOUT", 10 * time.Minute, "timeout of a database or calendar import"},
+	{"GEOIP_DB", "", "path to a MaxMind city database (mmdb) used to locate visitors, disabled if empty"},
+	{"PRIVACY_IP_MODE", IPTruncate, "how visitor addresses are stored: full, truncate or hash"},
+	{"PRIVACY_VISITOR_HISTORY", false, "store the last page and referer of each visitor, which can reveal what they searched"},
+	{"PRIVACY_HONOUR_DNT", true, "do not track visitors sending DNT: 1 or Sec-GPC: 1"},
+	{"STATS_RETENTION_DAYS", 90, "days after which visitor and search stats, and sent notifications, are deleted (0 keeps them forever)"},
+	{"BOT_USER_AGENTS", []string{}, "user agent substrings identifying bots, besides the well known ones"},
+	{"BOT_MAX_PER_MINUTE", 60, "requests per minute above which a client is considered a bot (0 disables the check)"},
+	{"FEEDBACK_PER_HOUR", 10, "maximum number of feedback reports accepted per hour from one client"},
+	{"SUGGESTIONS_PER_HOUR", 30, "maximum number of missing words suggested per hour from one client"},
+}
+
+// NewConfig reads config.toml from path, if present. Values can be
+// overridden through environment variables.
 func NewConfig(path string) *AppConfig {
 	v := viper.New()
+	for _, k := range configKeys {
+		v.SetDefault(k.key, k.value)
+	}
+	v.SetEnvPrefix(EnvPrefix)
+	v.AutomaticEnv()
 	v.SetConfigName("config")
 	v.SetConfigType("toml")
 	v.AddConfigPath(path)
 	err := v.ReadInConfig()
 	if err != nil {
-		panic(err.Error())
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			panic(err.Error())
+		}
 	}
 
 	return &AppConfig{v}
 }
 
 func NewAppConfig() *AppConfig {
-	return NewConfig("./config/")
+	return NewAppConfigFromArgs(os.Args[1:])
+}
+
+// NewAppConfigFromArgs parses the command-line arguments, reads the config
+// file from the --config directory and lets flags override both the file
+// and the environment.
+func NewAppConfigFromArgs(args []string) *AppConfig {
+	fs := pflag.NewFlagSet("dictionary", pflag.ExitOnError)
+	dir := os.Getenv(EnvPrefix + "_CONFIG")
+	if dir == "" {
+		dir = "./config/"
+	}
+	configDir := fs.String("config", dir, "directory containing config.toml")
+	for _, k := range configKeys {
+		name := flagName(k.key)
+		switch value := k.value.(type) {
+		case string:
+			fs.String(name, value, k.usage)
+		case int:
+			fs.Int(name, value, k.usage)
+		case bool:
+			fs.Bool(name, value, k.usage)
+		case time.Duration:
+			fs.Duration(name, value, k.usage)
+		case []string:
+			fs.StringSlice(name, value, k.usage)
+		}
+	}
+	fs.Parse(args)
+
+	config := NewConfig(*configDir)
+	for _, k := range configKeys {
+		config.v.BindPFlag(k.key, fs.Lookup(flagName(k.key)))
+	}
+	return config
+}
+
+func flagName(key string) string {
+	return strings.Replace(strings.ToLower(key), "_", "-", -1)
 }
 
 func NewCustomAppConfig(v *viper.Viper) *AppConfig {
@@ -41,6 +145,34 @@ func (val *AppConfig) GetPassDB() string {
 	return val.v.GetString("DB_PASS")
 }
 
+func (val *AppConfig) GetDBHost() string {
+	return val.v.GetString("DB_HOST")
+}
+
+func (val *AppConfig) GetDBPort() int {
+	return val.v.GetInt("DB_PORT")
+}
+
+func (val *AppConfig) GetDBSSLMode() string {
+	return val.v.GetString("DB_SSLMODE")
+}
+
+func (val *AppConfig) GetDBSSLRootCert() string {
+	return val.v.GetString("DB_SSLROOTCERT")
+}
+
+func (val *AppConfig) GetDBMaxOpenConns() int {
+	return val.v.GetInt("DB_MAX_OPEN_CONNS")
+}
+
+func (val *AppConfig) GetDBMaxIdleConns() int {
+	return val.v.GetInt("DB_MAX_IDLE_CONNS")
+}
+
+func (val *AppConfig) GetDBConnMaxLifetime() time.Duration {
+	return val.v.GetDuration("DB_CONN_MAX_LIFETIME")
+}
+
 func (val *AppConfig) GetHTTPDir() string {
 	return val.v.GetString("HTTP_DIR")
 }
@@ -80,3 +212,105 @@ func (val *AppConfig) GetAdminEmails() []string {
 func (val *AppConfig) GetSlackHook() string {
 	return val.v.GetString("SLACK_HOOK")
 }
+
+func (val *AppConfig) GetWebhookURL() string {
+	return val.v.GetString("WEBHOOK_URL")
+}
+
+// ReportSchedule is a periodic stats report, read from the [[REPORTS]]
+// tables of the config file.
+type ReportSchedule struct {
+	Name     string // subject, e.g. "Weekly report" by default
+	Period   string // daily, weekly or monthly
+	At       string // time of day, e.g. "16:00"
+	Weekday  string // day of a weekly report, e.g. "monday"
+	Day      int    // day of the month of a monthly report
+	Timezone string // e.g. "Europe/Rome", the server's if empty
+	Channel  string
+	Format   string // text, slack or html
+}
+
+// GetReports returns the scheduled reports. Without a REPORTS section, a
+// daily text report is sent at 16:00 to the NOTIFY_DAILY_REPORT channels.
+func (val *AppConfig) GetReports() ([]ReportSchedule, error) {
+	var reports []ReportSchedule
+	if err := val.v.UnmarshalKey("REPORTS", &reports); err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		for _, channel := range val.GetNotifyChannels("daily-report") {
+			reports = append(reports, ReportSchedule{Period: "daily", At: "16:00", Channel: channel, Format: FormatText})
+		}
+	}
+	return reports, nil
+}
+
+// GetNotifyChannels returns the channels an event, e.g. "daily-report", is
+// sent to.
+func (val *AppConfig) GetNotifyChannels(event string) []string {
+	return val.v.GetStringSlice("NOTIFY_" + strings.ToUpper(strings.Replace(event, "-", "_", -1)))
+}
+
+func (val *AppConfig) GetLogFormat() string {
+	return val.v.GetString("LOG_FORMAT")
+}
+
+func (val *AppConfig) GetLogLevel() string {
+	return val.v.GetString("LOG_LEVEL")
+}
+
+func (val *AppConfig) GetSlowQueryThreshold() time.Duration {
+	return val.v.GetDuration("SLOW_QUERY_THRESHOLD")
+}
+
+func (val *AppConfig) GetSearchTimeout() time.Duration {
+	return val.v.GetDuration("SEARCH_TIMEOUT")
+}
+
+func (val *AppConfig) GetAutocompleteTimeout() time.Duration {
+	return val.v.GetDuration("AUTOCOMPLETE_TIMEOUT")
+}
+
+func (val *AppConfig) GetCalendarTimeout() time.Duration {
+	return val.v.GetDuration("CALENDAR_TIMEOUT")
+}
+
+func (val *AppConfig) GetImportTimeout() time.Duration {
+	return val.v.GetDuration("IMPORT_TIMEOUT")
+}
+
+func (val *AppConfig) GetFeedbackPerHour() int {
+	return val.v.GetInt("FEEDBACK_PER_HOUR")
+}
+
+func (val *AppConfig) GetSuggestionsPerHour() int {
+	return val.v.GetInt("SUGGESTIONS_PER_HOUR")
+}
+
+func (val *AppConfig) GetBotUserAgents() []string {
+	return val.v.GetStringSlice("BOT_USER_AGENTS")
+}
+
+func (val *AppConfig) GetBotMaxPerMinute() int {
+	return val.v.GetInt("BOT_MAX_PER_MINUTE")
+}
+
+func (val *AppConfig) GetGeoIPDB() string {
+	return val.v.GetString("GEOIP_DB")
+}
+
+func (val *AppConfig) GetPrivacyIPMode() string {
+	return val.v.GetString("PRIVACY_IP_MODE")
+}
+
+func (val *AppConfig) GetPrivacyVisitorHistory() bool {
+	return val.v.GetBool("PRIVACY_VISITOR_HISTORY")
+}
+
+func (val *AppConfig) GetPrivacyHonourDNT() bool {
+	return val.v.GetBool("PRIVACY_HONOUR_DNT")
+}
+
+func (val *AppConfig) GetStatsRetentionDays() int {
+	return val.v.GetInt("STATS_RETENTION_DAYS")
+}
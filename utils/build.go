@@ -0,0 +1,24 @@
+package utils
+
+import "runtime/debug"
+
+// BuildCommit is set at link time:
+//
+//	go build -ldflags "-X github.com/beppeben/go-dictionary/utils.BuildCommit=$(git rev-parse HEAD)"
+var BuildCommit = ""
+
+// GetBuildCommit returns the commit the binary was built from, falling back
+// to the version control information recorded by the go tool.
+func GetBuildCommit() string {
+	if BuildCommit != "" {
+		return BuildCommit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoCacheSize bounds the number of addresses remembered by the geolocator.
+// The cache is simply emptied when it is full.
+const geoCacheSize = 10000
+
+type GeoConfig interface {
+	GetGeoIPDB() string
+}
+
+type Location struct {
+	City    string
+	Region  string
+	Country string
+}
+
+type Geolocator interface {
+	// Locate returns the location of ip, or nil if it is unknown.
+	Locate(ip string) *Location
+	Close() error
+}
+
+// NewGeolocator opens the MaxMind database configured in GEOIP_DB. If there
+// is none, the returned geolocator never finds anything.
+func NewGeolocator(c GeoConfig) (Geolocator, error) {
+	if c.GetGeoIPDB() == "" {
+		log.Info("No geolocation database configured")
+		return noGeolocator{}, nil
+	}
+	reader, err := geoip2.Open(c.GetGeoIPDB())
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbGeolocator{reader: reader, cache: make(map[string]*Location)}, nil
+}
+
+type noGeolocator struct{}
+
+func (noGeolocator) Locate(ip string) *Location {
+	return nil
+}
+
+func (noGeolocator) Close() error {
+	return nil
+}
+
+type mmdbGeolocator struct {
+	reader *geoip2.Reader
+	mutex  sync.Mutex
+	cache  map[string]*Location
+}
+
+func (g *mmdbGeolocator) Locate(ip string) *Location {
+	g.mutex.Lock()
+	location, ok := g.cache[ip]
+	g.mutex.Unlock()
+	if ok {
+		return location
+	}
+
+	if parsed := net.ParseIP(ip); parsed != nil {
+		record, err := g.reader.City(parsed)
+		if err != nil {
+			log.Debugf("Cannot locate %s: %v", ip, err)
+		} else if record.Country.IsoCode != "" {
+			location = &Location{City: record.City.Names["en"], Country: record.Country.IsoCode}
+			if len(record.Subdivisions) > 0 {
+				location.Region = record.Subdivisions[0].Names["en"]
+			}
+		}
+	}
+
+	g.mutex.Lock()
+	if len(g.cache) >= geoCacheSize {
+		g.cache = make(map[string]*Location)
+	}
+	g.cache[ip] = location
+	g.mutex.Unlock()
+	return location
+}
+
+func (g *mmdbGeolocator) Close() error {
+	return g.reader.Close()
+}
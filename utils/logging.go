@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type LogConfig interface {
+	GetLogFormat() string
+	GetLogLevel() string
+}
+
+type loggerKey struct{}
+
+// SetupLogging configures the standard logger: LOG_FORMAT selects "json" or
+// "text" output and LOG_LEVEL the minimum level.
+func SetupLogging(c LogConfig) {
+	if c.GetLogFormat() == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{DisableColors: true})
+	}
+	level, err := log.ParseLevel(c.GetLogLevel())
+	if err != nil {
+		log.Warnf("Invalid log level %q, using debug", c.GetLogLevel())
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+}
+
+// WithLogger returns a copy of ctx carrying a request-scoped logger.
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger stored in ctx, or the standard logger.
+func Logger(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -2,11 +2,21 @@ package utils
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	//"net/smtp"
-	//"time"
-	//log "github.com/Sirupsen/logrus"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// message formats: plain text for every channel, Slack blocks (a JSON array)
+// for Slack only and HTML for email only
+const (
+	FormatText  = "text"
+	FormatSlack = "slack"
+	FormatHTML  = "html"
 )
 
 type MessageConfig interface {
@@ -16,70 +26,192 @@ type MessageConfig interface {
 	GetSMTPPort() string
 	GetAdminEmails() []string
 	GetSlackHook() string
+	GetWebhookURL() string
+}
+
+// Message is a notification ready to be delivered. The attachment, if any,
+// is a CSV file.
+type Message struct {
+	Event          string
+	Subject        string
+	Body           string
+	Format         string
+	AttachmentName string
+	Attachment     string
+}
+
+// Notifier delivers a message on one channel. Send makes a single attempt,
+// retries are up to the caller.
+type Notifier interface {
+	Send(m *Message) error
+}
+
+// channelFormats lists the formats each channel can deliver.
+var channelFormats = map[string][]string{
+	"slack":   {FormatText, FormatSlack},
+	"email":   {FormatText, FormatHTML},
+	"webhook": {FormatText},
 }
 
+// SupportsFormat tells if messages in format can be sent on channel.
+func SupportsFormat(channel, format string) bool {
+	for _, f := range channelFormats[channel] {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
 type MessageUtils struct {
-	config MessageConfig
+	config    MessageConfig
+	notifiers map[string]Notifier
 }
 
+// NewMessageUtils sets up the channels that are configured: "slack",
+// "email" (to the admin emails) and "webhook".
 func NewMessageUtils(config MessageConfig) *MessageUtils {
-	return &MessageUtils{config}
+	u := &MessageUtils{config: config, notifiers: make(map[string]Notifier)}
+	if config.GetSlackHook() != "" {
+		u.notifiers["slack"] = &SlackNotifier{Hook: config.GetSlackHook()}
+	}
+	if config.GetSMTP() != "" && len(config.GetAdminEmails()) > 0 {
+		u.notifiers["email"] = &EmailNotifier{utils: u}
+	}
+	if config.GetWebhookURL() != "" {
+		u.notifiers["webhook"] = &WebhookNotifier{URL: config.GetWebhookURL()}
+	}
+	return u
 }
 
-func (u *MessageUtils) SendToSlack(msg string) error {
-	type SlackMessage struct {
-		Text string `json:"text"`
+func (u *MessageUtils) HasChannel(channel string) bool {
+	return u.notifiers[channel] != nil
+}
+
+func (u *MessageUtils) Send(channel string, m *Message) error {
+	notifier := u.notifiers[channel]
+	if notifier == nil {
+		return fmt.Errorf("Notification channel %s is not configured", channel)
 	}
-	message := SlackMessage{Text: msg}
-	buff := new(bytes.Buffer)
-	json.NewEncoder(buff).Encode(message)
-	_, err := http.Post(u.config.GetSlackHook(), "application/json; charset=utf-8", buff)
+	return notifier.Send(m)
+}
+
+func (u *MessageUtils) SendToSlack(msg string) error {
+	return (&SlackNotifier{Hook: u.config.GetSlackHook()}).Send(&Message{Body: msg})
+}
 
-	return err
+func (u *MessageUtils) SendEmail(toEmail string, subject string, body string) error {
+	return u.sendMail([]string{toEmail}, &Message{Subject: subject, Body: body})
 }
 
-/*
-func (u *MessageUtils) SendEmailOnce(toEmail string, subject string, body string) error {
+// sendMail sends m to all of toEmails at once, as plain text or HTML, in a
+// multipart message if it has an attachment.
+func (u *MessageUtils) sendMail(toEmails []string, m *Message) error {
 	auth := smtp.PlainAuth("", u.config.GetServiceEmail(), u.config.GetEmailPass(), u.config.GetSMTP())
-	to := []string{toEmail}
-	msg := []byte(
-		"To: " + toEmail + "\r\n" +
-			"From: " + u.config.GetServiceEmail() + "\r\n" +
-			"Subject: " + subject + "\r\n" +
-			"\r\n" + body + "\r\n")
-	err := smtp.SendMail(u.config.GetSMTP()+":"+u.config.GetSMTPPort(), auth,
-		u.config.GetServiceEmail(), to, msg)
-	if err != nil {
-		log.Infof("Can't send email to %s: %v", toEmail, err)
+	contentType := "text/plain; charset=utf-8"
+	if m.Format == FormatHTML {
+		contentType = "text/html; charset=utf-8"
 	}
+	var buff bytes.Buffer
+	buff.WriteString("To: " + strings.Join(toEmails, ", ") + "\r\n" +
+		"From: " + u.config.GetServiceEmail() + "\r\n" +
+		"Subject: " + m.Subject + "\r\n" +
+		"MIME-Version: 1.0\r\n")
+	if m.Attachment == "" {
+		buff.WriteString("Content-Type: " + contentType + "\r\n\r\n" + m.Body + "\r\n")
+	} else {
+		boundary := fmt.Sprintf("dictionary-%d", time.Now().UnixNano())
+		buff.WriteString("Content-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n" +
+			"--" + boundary + "\r\n" +
+			"Content-Type: " + contentType + "\r\n\r\n" + m.Body + "\r\n" +
+			"--" + boundary + "\r\n" +
+			"Content-Type: text/csv; charset=utf-8\r\n" +
+			"Content-Disposition: attachment; filename=\"" + m.AttachmentName + "\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n")
+		encoded := base64.StdEncoding.EncodeToString([]byte(m.Attachment))
+		for len(encoded) > 76 {
+			buff.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		buff.WriteString(encoded + "\r\n--" + boundary + "--\r\n")
+	}
+	return smtp.SendMail(u.config.GetSMTP()+":"+u.config.GetSMTPPort(), auth,
+		u.config.GetServiceEmail(), toEmails, buff.Bytes())
+}
 
-	return err
+func (u *MessageUtils) SendEmailToAdmins(subject, body string) error {
+	return u.sendMailToAdmins(&Message{Subject: subject, Body: body})
 }
 
-func (u *MessageUtils) SendEmail(toEmail string, subject string, body string) error {
-	retries := 4
-	var err error
-	for retries > 0 {
-		err = u.SendEmailOnce(toEmail, subject, body)
-		if err == nil {
-			break
-		} else {
-			retries--
-			time.Sleep(time.Second * 10)
-		}
+// sendMailToAdmins sends a single message to all the admins, so that a retry
+// does not send it again to those who already got it.
+func (u *MessageUtils) sendMailToAdmins(m *Message) error {
+	return u.sendMail(u.config.GetAdminEmails(), m)
+}
+
+type SlackNotifier struct {
+	Hook string
+}
+
+// Send posts the body as text, or as blocks in the Slack format, with the
+// subject as fallback text.
+func (n *SlackNotifier) Send(m *Message) error {
+	type SlackMessage struct {
+		Text   string          `json:"text"`
+		Blocks json.RawMessage `json:"blocks,omitempty"`
 	}
-	if err != nil {
-		log.Warnf("Can't send email to %s: %v", toEmail, err)
+	if m.Format == FormatSlack {
+		return postJSON(n.Hook, SlackMessage{Text: m.Subject, Blocks: json.RawMessage(m.Body)})
+	}
+	text := m.Body
+	if m.Subject != "" {
+		text = m.Subject + ": " + m.Body
 	}
-	return err
+	return postJSON(n.Hook, SlackMessage{Text: text})
 }
 
-func (u *MessageUtils) SendEmailToAdmins(subject, body string) (err error) {
-	for _, email := range u.config.GetAdminEmails() {
-		if err == nil {
-			err = u.SendEmail(email, subject, body)
-		}
+type EmailNotifier struct {
+	utils *MessageUtils
+}
+
+func (n *EmailNotifier) Send(m *Message) error {
+	return n.utils.sendMailToAdmins(m)
+}
+
+// WebhookNotifier posts the event, subject, body and attachment as a JSON
+// object.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n *WebhookNotifier) Send(m *Message) error {
+	type WebhookMessage struct {
+		Event          string    `json:"event"`
+		Subject        string    `json:"subject"`
+		Body           string    `json:"body"`
+		AttachmentName string    `json:"attachment_name,omitempty"`
+		Attachment     string    `json:"attachment,omitempty"`
+		Time           time.Time `json:"time"`
+	}
+	return postJSON(n.URL, WebhookMessage{Event: m.Event, Subject: m.Subject, Body: m.Body,
+		AttachmentName: m.AttachmentName, Attachment: m.Attachment, Time: time.Now()})
+}
+
+// postJSON fails unless the server replies with a 2xx status.
+func postJSON(url string, message interface{}) error {
+	buff := new(bytes.Buffer)
+	if err := json.NewEncoder(buff).Encode(message); err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(url, "application/json; charset=utf-8", buff)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s replied %s", strings.SplitN(url, "?", 2)[0], resp.Status)
 	}
-	return
+	return nil
 }
-*/
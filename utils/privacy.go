@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+const (
+	IPFull     = "full"
+	IPTruncate = "truncate"
+	IPHash     = "hash"
+)
+
+// IPAnonymizer stores visitor addresses according to PRIVACY_IP_MODE:
+// as they are, truncated to their /24 (IPv4) or /48 (IPv6) network, or
+// hashed with a key drawn at startup, so that hashes cannot be reversed by
+// trying every address and cannot be linked across restarts.
+type IPAnonymizer struct {
+	mode string
+	key  []byte
+}
+
+func NewIPAnonymizer(mode string) (*IPAnonymizer, error) {
+	a := &IPAnonymizer{mode: mode}
+	switch mode {
+	case IPFull, IPTruncate:
+	case IPHash:
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown ip mode %q (expected full, truncate or hash)", mode)
+	}
+	return a, nil
+}
+
+func (a *IPAnonymizer) Mode() string {
+	return a.mode
+}
+
+func (a *IPAnonymizer) Anonymize(ip string) string {
+	switch a.mode {
+	case IPTruncate:
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ""
+		}
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return parsed.Mask(net.CIDRMask(48, 128)).String()
+	case IPHash:
+		if ip == "" {
+			return ""
+		}
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return ip
+}
@@ -10,3 +10,56 @@ func TestStrings(t *testing.T) {
 	msgutils := NewMessageUtils(config)
 	msgutils.SendToSlack("test")
 }
+
+func TestAnonymizeIP(t *testing.T) {
+	truncate, _ := NewIPAnonymizer(IPTruncate)
+	for ip, expected := range map[string]string{
+		"89.3.117.15":                     "89.3.117.0",
+		"2001:db8:85a3:1:2:8a2e:370:7334": "2001:db8:85a3::",
+		"not an ip":                       "",
+	} {
+		if got := truncate.Anonymize(ip); got != expected {
+			t.Errorf("truncating %s: expected %q, got %q", ip, expected, got)
+		}
+	}
+	hash, _ := NewIPAnonymizer(IPHash)
+	if h := hash.Anonymize("89.3.117.15"); len(h) != 16 || h != hash.Anonymize("89.3.117.15") {
+		t.Errorf("hash %q is not stable", h)
+	}
+	if _, err := NewIPAnonymizer("partial"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := HashPassword("correct horse")
+	if hash == other {
+		t.Error("hashes are not salted")
+	}
+	for password, ok := range map[string]bool{"correct horse": true, "correct horse ": false, "": false} {
+		if CheckPassword(hash, password) != ok {
+			t.Errorf("checking %q: expected %v", password, ok)
+		}
+	}
+	if CheckPassword("not a hash", "correct horse") {
+		t.Error("invalid hash accepted")
+	}
+}
+
+func TestToken(t *testing.T) {
+	token, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewToken()
+	if len(token) != 69 || token[:5] != "dict_" || token == other {
+		t.Errorf("unexpected tokens %s and %s", token, other)
+	}
+	if hash := HashToken(token); len(hash) != 64 || hash != HashToken(token) || hash == HashToken(other) {
+		t.Errorf("hash %s is not stable", hash)
+	}
+}
@@ -1,47 +1,85 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const (
+	defaultTokenDays = 90
+	maxTokenDays     = 365
 )
 
 func (handler WebserviceHandler) DeployFront(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
 	file, _, err := r.FormFile("bundle")
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "ERROR_BAD_FILE")
 		return
 	}
 	defer file.Close()
+	if err = auditUpload(r, file); err != nil {
+		panic(err)
+	}
 	err = handler.sutils.ExtractZipToHttpDir(file, r.ContentLength)
 	if err == nil {
 		fmt.Fprintf(w, "OK")
 	} else {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "ERROR")
 	}
 }
 
+// DeployCal replaces the calendar with an xlsx workbook, or imports the
+// events of an .ics file, see DeployCalICS.
 func (handler WebserviceHandler) DeployCal(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Receiving calendar file")
-	file, _, err := r.FormFile("bundle")
+	logger := utils.Logger(r.Context())
+	logger.Debug("Receiving calendar file")
+	file, header, err := r.FormFile("bundle")
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "Error receiving excel file: %v", err)
 		return
 	}
-	log.Debug("Copying file to folder")
+	defer file.Close()
+	if err = auditUpload(r, file); err != nil {
+		panic(err)
+	}
+	if strings.HasSuffix(strings.ToLower(header.Filename), ".ics") {
+		handler.DeployCalICS(w, r, file)
+		return
+	}
+	logger.Debug("Copying file to folder")
 	err = handler.sutils.CopyFileToExcelDir(file, "calendar.xlsx")
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "Error copying excel file: %v", err)
 		return
 	}
-	err = handler.repo.ResetCalendar()
+	t1 := time.Now()
+	ctx, cancel := handler.importContext(r)
+	defer cancel()
+	counts, err := handler.repo.ResetCalendar(ctx)
+	handler.metrics.ObserveImport("calendar", time.Since(t1), err)
+	if record := getAudit(r); record != nil {
+		record.RowCounts = counts
+	}
+	handler.notifyImport(r, "calendar", counts, err)
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "Error resetting calendar: %v", err)
 		return
 	}
@@ -49,26 +87,203 @@ func (handler WebserviceHandler) DeployCal(w http.ResponseWriter, r *http.Reques
 }
 
 func (handler WebserviceHandler) DeployDb(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Receiving db file")
+	logger := utils.Logger(r.Context())
+	logger.Debug("Receiving db file")
 	file, _, err := r.FormFile("bundle")
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "Error receiving excel file: %v", err)
 		return
 	}
 	defer file.Close()
-	log.Debug("Copying file to folder")
+	if err = auditUpload(r, file); err != nil {
+		panic(err)
+	}
+	logger.Debug("Copying file to folder")
 	err = handler.sutils.CopyFileToExcelDir(file, "mydb.xlsx")
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "Error copying excel file: %v", err)
 		return
 	}
-	err = handler.repo.ResetDB()
+	t1 := time.Now()
+	ctx, cancel := handler.importContext(r)
+	defer cancel()
+	counts, err := handler.repo.ResetDB(ctx)
+	handler.metrics.ObserveImport("db", time.Since(t1), err)
+	if record := getAudit(r); record != nil {
+		record.RowCounts = counts
+	}
+	handler.notifyImport(r, "database", counts, err)
 	if err != nil {
-		log.Warnf("%s", err)
+		logger.Warnf("%s", err)
+		auditError(r, err)
 		fmt.Fprintf(w, "Error resetting database: %v", err)
 		return
 	}
 	fmt.Fprintf(w, "OK")
 }
+
+func (handler WebserviceHandler) UpdateWebString(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	lang := handler.repo.GetLangFromKey(r.Context(), r.FormValue("lang"))
+	if lang == "" {
+		err := fmt.Errorf("invalid language %s", r.FormValue("lang"))
+		auditError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := r.FormValue("key")
+	err := handler.repo.UpdateWebTerm(r.Context(), lang, key, r.FormValue("value"))
+	if err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error updating web string: %v", err)
+		return
+	}
+	logger.Infof("Web string %s updated in %s", key, lang)
+	fmt.Fprintf(w, "OK")
+}
+
+func (handler WebserviceHandler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	lang := handler.repo.GetLangFromKey(r.Context(), r.FormValue("lang"))
+	if lang == "" {
+		err := fmt.Errorf("invalid language %s", r.FormValue("lang"))
+		auditError(r, err)
+		fmt.Fprintf(w, "Error updating entry: %v", err)
+		return
+	}
+	enId, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		auditError(r, err)
+		fmt.Fprintf(w, "Error updating entry: invalid id %s", r.FormValue("id"))
+		return
+	}
+	word := r.FormValue("word")
+	field := r.FormValue("field")
+	err = handler.repo.UpdateEntry(r.Context(), lang, enId, word, field, r.FormValue("value"))
+	if err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error updating entry: %v", err)
+		return
+	}
+	logger.Infof("Field %s of %s (%d) updated in %s", field, word, enId, lang)
+	fmt.Fprintf(w, "OK")
+}
+
+type TokenInfo struct {
+	Id          int64        `json:"id"`
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+	Expires     time.Time    `json:"expires"`
+	CreatedBy   string       `json:"created_by"`
+	Created     time.Time    `json:"created"`
+	Revoked     bool         `json:"revoked"`
+	// only set in the reply to the creation, the secret is not stored
+	Token string `json:"token,omitempty"`
+}
+
+func newTokenInfo(t *ApiToken) *TokenInfo {
+	return &TokenInfo{Id: t.Id, Name: t.Name, Permissions: t.Permissions, Expires: t.Expires,
+		CreatedBy: t.CreatedBy, Created: t.Created, Revoked: t.Revoked}
+}
+
+func (handler WebserviceHandler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := handler.repo.ListTokens(r.Context())
+	if err != nil {
+		panic(err)
+	}
+	infos := make([]*TokenInfo, len(tokens))
+	for i, t := range tokens {
+		infos[i] = newTokenInfo(t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// CreateToken expects the form values name, permissions (comma separated)
+// and days of validity. The token secret is only shown in the reply.
+func (handler WebserviceHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		auditError(r, fmt.Errorf("missing name"))
+		fmt.Fprintf(w, "Error creating token: missing name")
+		return
+	}
+	perms := make([]Permission, 0)
+	for _, s := range strings.Split(r.FormValue("permissions"), ",") {
+		perm, err := ParseTokenPermission(strings.TrimSpace(s))
+		if err != nil {
+			auditError(r, err)
+			fmt.Fprintf(w, "Error creating token: %v", err)
+			return
+		}
+		perms = append(perms, perm)
+	}
+	days := defaultTokenDays
+	if r.FormValue("days") != "" {
+		var err error
+		days, err = strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 || days > maxTokenDays {
+			err = fmt.Errorf("days must be between 1 and %d", maxTokenDays)
+			auditError(r, err)
+			fmt.Fprintf(w, "Error creating token: %v", err)
+			return
+		}
+	}
+	secret, err := utils.NewToken()
+	if err != nil {
+		panic(err)
+	}
+	token := &ApiToken{Name: name, Permissions: perms, Expires: time.Now().AddDate(0, 0, days),
+		CreatedBy: getPrincipal(r).Name}
+	err = handler.repo.CreateToken(r.Context(), token, utils.HashToken(secret))
+	if err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error creating token: %v", err)
+		return
+	}
+	logger.Infof("Token %d (%s) created with permissions %v", token.Id, name, perms)
+	info := newTokenInfo(token)
+	info.Token = secret
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (handler WebserviceHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	id, err := strconv.ParseInt(getParams(r).ByName("id"), 10, 64)
+	if err != nil {
+		auditError(r, err)
+		fmt.Fprintf(w, "Error revoking token: invalid id %s", getParams(r).ByName("id"))
+		return
+	}
+	if err = handler.repo.RevokeToken(r.Context(), id); err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error revoking token: %v", err)
+		return
+	}
+	logger.Infof("Token %d revoked", id)
+	fmt.Fprintf(w, "OK")
+}
+
+func (handler WebserviceHandler) notifyImport(r *http.Request, what string, counts map[string]int, err error) {
+	user := ""
+	if principal := getPrincipal(r); principal != nil {
+		user = " by " + principal.Name
+	}
+	if err != nil {
+		handler.notifier.Enqueue(r.Context(), EventImport, "Import failed",
+			fmt.Sprintf("The %s import%s failed: %v", what, user, err))
+		return
+	}
+	handler.notifier.Enqueue(r.Context(), EventImport, "Import succeeded",
+		fmt.Sprintf("The %s was imported%s: %s", what, user, formatCounts(counts)))
+}
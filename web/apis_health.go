@@ -0,0 +1,49 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+type VersionInfo struct {
+	Commit            string    `json:"commit"`
+	DictionaryVersion string    `json:"dictionary_version"`
+	Languages         int       `json:"languages"`
+	LastImport        time.Time `json:"last_import"`
+}
+
+// Healthz only tells that the process is alive and serving requests.
+func (handler WebserviceHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "OK")
+}
+
+// Readyz fails while the database is unreachable, the caches are being built
+// or a database import is in progress.
+func (handler WebserviceHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	if err := handler.repo.Ping(r.Context()); err != nil {
+		http.Error(w, "Database unreachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	status := handler.repo.GetStatus(r.Context())
+	if status.Importing {
+		http.Error(w, "Import in progress", http.StatusServiceUnavailable)
+		return
+	}
+	if !status.Ready {
+		http.Error(w, "Caches not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+func (handler WebserviceHandler) Version(w http.ResponseWriter, r *http.Request) {
+	status := handler.repo.GetStatus(r.Context())
+	info := &VersionInfo{Commit: utils.GetBuildCommit(), DictionaryVersion: status.Version,
+		Languages: status.Languages, LastImport: status.LastImport}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
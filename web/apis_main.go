@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -10,14 +11,16 @@ import (
 	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	. "github.com/beppeben/go-dictionary/domain"
 	"github.com/beppeben/go-dictionary/utils"
-	"github.com/gorilla/context"
-	"github.com/julienschmidt/httprouter"
 )
 
+const maxSuggestionLength = 255
+
+// MONTHS and WEEKDAYS are the English names, used where the web strings
+// month_1 to month_12 and weekday_1 (Monday) to weekday_7 are missing.
 var MONTHS = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+var WEEKDAYS = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
 
 type HtmlContent struct {
 	Languages   []*Language
@@ -25,12 +28,25 @@ type HtmlContent struct {
 	Fields      []string
 	FieldDescs  []string
 	BaseLangTag string
+	Privacy     *PrivacyStatement
+}
+
+// PrivacyStatement describes what is kept about visitors, for the terms page.
+type PrivacyStatement struct {
+	IPMode         string
+	VisitorHistory bool
+	HonourDNT      bool
+	Geolocation    bool
+	RetentionDays  int
 }
 
 type CalendarDay struct {
 	Day     int
 	Active  bool
 	IsToday bool
+	// Date (YYYY-MM-DD) and Events are only set in the year view
+	Date   string
+	Events int
 }
 
 type CalendarEventHtml struct {
@@ -46,6 +62,8 @@ type CalendarEventHtml struct {
 }
 
 type CalendarContent struct {
+	LangTag   string
+	Weekdays  []string
 	Month     string
 	Year      int
 	PrevMonth int
@@ -54,9 +72,10 @@ type CalendarContent struct {
 	NextYear  int
 	Days      []CalendarDay
 	Events    []CalendarEventHtml
+	Nav       *CalendarNav
 }
 
-func (handler WebserviceHandler) getHelpers(baseLang string) template.FuncMap {
+func (handler WebserviceHandler) getHelpers(ctx context.Context, baseLang string) template.FuncMap {
 	return template.FuncMap{
 		"oddOrEven": func(num int) string {
 			if math.Mod(float64(num), 2) != 0 {
@@ -72,10 +91,10 @@ func (handler WebserviceHandler) getHelpers(baseLang string) template.FuncMap {
 			return num - 1
 		},
 		"getString": func(key string) string {
-			return handler.repo.GetWebTerm(baseLang, key)
+			return handler.repo.GetWebTerm(ctx, baseLang, key)
 		},
 		"getHtml": func(key string) template.HTML {
-			return template.HTML(handler.repo.GetWebTerm(baseLang, key))
+			return template.HTML(handler.repo.GetWebTerm(ctx, baseLang, key))
 		},
 		"getShort": func(text string, span int) string {
 			max_len := span * 15
@@ -90,23 +109,36 @@ func (handler WebserviceHandler) getHelpers(baseLang string) template.FuncMap {
 func (handler WebserviceHandler) CalendarHTMLDefault(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
 	url := "/calendar/" + strconv.Itoa(now.Year()) + "/" + strconv.Itoa(int(now.Month()))
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func positive(a float64) int {
-	if a > 0 {
-		return int(a)
-	} else {
-		return 0
+// webString returns the web string key in lang, or the fallback if missing.
+func (handler WebserviceHandler) webString(ctx context.Context, lang, key, fallback string) string {
+	if s := handler.repo.GetWebTerm(ctx, lang, key); s != "" {
+		return s
 	}
+	return fallback
 }
 
 func (handler WebserviceHandler) CalendarHTML(w http.ResponseWriter, r *http.Request) {
-	baseLang := handler.getBaseLanguage(r.FormValue("lang"))
-	ps := context.Get(r, "params").(httprouter.Params)
+	ps := getParams(r)
+	// the tag feeds and the week view share this route, as
+	// /calendar/tag/:tag.ics and /calendar/week/:date
+	switch ps.ByName("year") {
+	case "tag":
+		handler.CalendarICS(w, r)
+		return
+	case "week":
+		handler.CalendarWeekHTML(w, r)
+		return
+	}
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
 	yearStr := ps.ByName("year")
 	monthStr := ps.ByName("month")
-	log.Infof("Year %s month %s", yearStr, monthStr)
+	utils.Logger(r.Context()).Infof("Year %s month %s", yearStr, monthStr)
 	yearNum, err := strconv.Atoi(yearStr)
 	if err != nil {
 		panic("Bad format")
@@ -116,8 +148,7 @@ func (handler WebserviceHandler) CalendarHTML(w http.ResponseWriter, r *http.Req
 		panic("Bad format")
 	}
 
-	htmlHelpers := handler.getHelpers(baseLang)
-	t := template.Must(template.New("calendar.html").Funcs(htmlHelpers).ParseFiles(handler.config.GetHTTPDir() + "calendar.html"))
+	t := handler.calendarTemplate(r.Context(), "calendar.html", baseLang)
 
 	// compute previus/next month/year
 	nextMonth := monthNum + 1
@@ -149,7 +180,7 @@ func (handler WebserviceHandler) CalendarHTML(w http.ResponseWriter, r *http.Req
 	now := time.Now()
 	for ; d.AddDate(0, 0, i).Month() == d.Month(); i++ {
 		day := CalendarDay{Day: i + 1, Active: true}
-		if now.Day() == day.Day && now.Month() == d.Month() {
+		if now.Day() == day.Day && now.Month() == d.Month() && now.Year() == d.Year() {
 			day.IsToday = true
 		}
 		days = append(days, day)
@@ -159,98 +190,42 @@ func (handler WebserviceHandler) CalendarHTML(w http.ResponseWriter, r *http.Req
 		day := CalendarDay{Day: i + 1, Active: false}
 		days = append(days, day)
 	}
-	max_row := (len(days)-1)/7 + 2
 
 	// place events
-	events, err := handler.repo.GetCalendarEvents(monthNum, yearNum)
+	ctx, cancel := handler.withTimeout(r, handler.config.GetCalendarTimeout())
+	defer cancel()
+	events, err := handler.repo.GetCalendarEvents(ctx, monthNum, yearNum, baseLang)
 	if err != nil {
 		panic(err)
 	}
-	log.Infof("%d events", len(events))
-	html_events := make([]CalendarEventHtml, 0)
-	counter := 1
-	for i, _ := range events {
-		html_event := CalendarEventHtml{Id: counter, Tag: events[i].Tag, Title: events[i].Title, Description: template.HTML(events[i].Description)}
-		counter = counter + 1
-		/*
-			for j := 0; j < i; j++ {
-				if !events[j].EndDate.Before(events[i].StartDate) && !events[j].StartDate.After(events[i].EndDate) {
-					html_event.Level = html_event.Level + 1
-				}
-			}
-		*/
-		html_event.Row = (positive(events[i].StartDate.Sub(first_day).Hours()/24))/7 + 2
-		html_event.Column = (positive(events[i].StartDate.Sub(first_day).Hours()/24))%7 + 1
-		if events[i].StartDate.After(first_day) {
-			html_event.Span = int(events[i].EndDate.Sub(events[i].StartDate).Hours()/24) + 1
-		} else {
-			html_event.Span = int(events[i].EndDate.Sub(first_day).Hours()/24) + 1
-			html_event.IsContinuation = true
-		}
-		html_events = append(html_events, html_event)
-
-		// place copies over multiple rows
-		row := html_event.Row
-		column := html_event.Column
-		span := html_event.Span
-		for column+span > 8 && row < max_row {
-			html_events[len(html_events)-1].Span = (8 - column)
-			span = span - (8 - column)
-			column = 1
-			row = row + 1
-			copy_event := html_event
-			copy_event.Span = span
-			copy_event.Column = column
-			copy_event.Row = row
-			copy_event.Id = counter
-			copy_event.IsContinuation = true
-			counter = counter + 1
-			html_events = append(html_events, copy_event)
-		}
-	}
+	utils.Logger(r.Context()).Infof("%d events", len(events))
+	html_events := layoutEvents(events, first_day, len(days)/7)
 
-	// compute visualization level (so they don't overlap)
-	for i, _ := range html_events {
-		var level_taken [50]bool
-		for j := 0; j < i; j++ {
-			if html_events[i].Row == html_events[j].Row &&
-				(html_events[i].Column >= html_events[j].Column && html_events[i].Column < html_events[j].Column+html_events[j].Span ||
-					html_events[j].Column >= html_events[i].Column && html_events[j].Column < html_events[i].Column+html_events[i].Span) {
-				level_taken[html_events[j].Level] = true
-			}
-		}
-		for k, taken := range level_taken {
-			if !taken {
-				html_events[i].Level = k
-				break
-			}
-		}
-	}
-
-	content := &CalendarContent{Month: MONTHS[monthNum-1], Year: yearNum, NextMonth: nextMonth, NextYear: nextYear,
-		PrevMonth: prevMonth, PrevYear: prevYear, Days: days, Events: html_events}
+	content := &CalendarContent{LangTag: baseLang[:3], Weekdays: handler.weekdayNames(r.Context(), baseLang),
+		Month: handler.monthName(r.Context(), baseLang, monthNum), Year: yearNum, NextMonth: nextMonth, NextYear: nextYear,
+		PrevMonth: prevMonth, PrevYear: prevYear, Days: days, Events: html_events, Nav: calendarNav(baseLang, "month", d)}
 	t.Execute(w, content)
 }
 
 func (handler WebserviceHandler) IndexHTML(w http.ResponseWriter, r *http.Request) {
-	baseLang := handler.getBaseLanguage(r.FormValue("lang"))
-	ps := context.Get(r, "params").(httprouter.Params)
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	ps := getParams(r)
 	key := ps.ByName("langkey")
 	term := ps.ByName("term")
-	htmlHelpers := handler.getHelpers(baseLang)
+	htmlHelpers := handler.getHelpers(r.Context(), baseLang)
 	t := template.Must(template.New("index.html").Funcs(htmlHelpers).ParseFiles(handler.config.GetHTTPDir() + "index.html"))
-	langs := handler.repo.GetLanguages(baseLang)
+	langs := handler.repo.GetLanguages(r.Context(), baseLang)
 	content := &HtmlContent{Languages: langs, BaseLangTag: baseLang[:3]}
 	if key != "" && term != "" {
-		fromLang, toLang := handler.getLanguagesFromRequest(ps.ByName("langkey"))
-		results, err := handler.repo.Search(term, fromLang, toLang, baseLang)
-		if err != nil {
+		fromLang, toLang := handler.getLanguagesFromRequest(r.Context(), ps.ByName("langkey"))
+		ctx, cancel := handler.withTimeout(r, handler.config.GetSearchTimeout())
+		defer cancel()
+		results, err := handler.repo.Search(ctx, term, fromLang, toLang, baseLang)
+		if err != nil && ctx.Err() == nil {
 			//trying the other way around
-			results, err = handler.repo.Search(term, toLang, fromLang, baseLang)
-			if err != nil {
-				panic(fmt.Sprintf("Word %s does not exist in %s/%s dictionary", term, fromLang, toLang))
-				//http.Redirect(w, r, "/", http.StatusFound)
-			} else {
+			_, err = handler.repo.Search(ctx, term, toLang, fromLang, baseLang)
+			if err == nil {
+				handler.metrics.CountSearch(fromLang, toLang, "reversed")
 				url := "/search/" + toLang[:3] + fromLang[:3] + "/" + term
 				if baseLang != "" {
 					url += "?lang=" + baseLang[:3]
@@ -259,6 +234,18 @@ func (handler WebserviceHandler) IndexHTML(w http.ResponseWriter, r *http.Reques
 				return
 			}
 		}
+		if err != nil && ctx.Err() != nil {
+			// not a miss, the word may well exist
+			utils.Logger(r.Context()).Warnf("Search of %s in %s/%s interrupted: %v", term, fromLang, toLang, ctx.Err())
+			http.Error(w, "Search timed out, please try again later", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			handler.metrics.CountSearch(fromLang, toLang, "miss")
+			panic(fmt.Sprintf("Word %s does not exist in %s/%s dictionary", term, fromLang, toLang))
+			//http.Redirect(w, r, "/", http.StatusFound)
+		}
+		handler.metrics.CountSearch(fromLang, toLang, "hit")
 		content.Results = results
 		//list of (non repeating) fields for all the words
 		for _, word := range results {
@@ -281,22 +268,42 @@ func (handler WebserviceHandler) TermsHTML(w http.ResponseWriter, r *http.Reques
 }
 
 func (handler WebserviceHandler) executeBasicTemplate(w http.ResponseWriter, r *http.Request, name string) {
-	baseLang := handler.getBaseLanguage(r.FormValue("lang"))
-	htmlHelpers := handler.getHelpers(baseLang)
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	htmlHelpers := handler.getHelpers(r.Context(), baseLang)
 	t := template.Must(template.New(name).Funcs(htmlHelpers).ParseFiles(handler.config.GetHTTPDir() + name))
-	langs := handler.repo.GetLanguages(baseLang)
-	content := &HtmlContent{Languages: langs, BaseLangTag: baseLang[:3]}
+	langs := handler.repo.GetLanguages(r.Context(), baseLang)
+	content := &HtmlContent{Languages: langs, BaseLangTag: baseLang[:3], Privacy: handler.privacyStatement()}
 	t.Execute(w, content)
 }
 
+func (handler WebserviceHandler) privacyStatement() *PrivacyStatement {
+	return &PrivacyStatement{
+		IPMode:         handler.ips.Mode(),
+		VisitorHistory: handler.config.GetPrivacyVisitorHistory(),
+		HonourDNT:      handler.config.GetPrivacyHonourDNT(),
+		Geolocation:    handler.config.GetGeoIPDB() != "",
+		RetentionDays:  handler.config.GetStatsRetentionDays(),
+	}
+}
+
 func (handler WebserviceHandler) Autocomplete(w http.ResponseWriter, r *http.Request) {
-	ps := context.Get(r, "params").(httprouter.Params)
-	fromLang, toLang := handler.getLanguagesFromRequest(ps.ByName("langkey"))
+	ps := getParams(r)
+	fromLang, toLang := handler.getLanguagesFromRequest(r.Context(), ps.ByName("langkey"))
 	term := strings.ToLower(r.FormValue("term"))
-	result, err := handler.repo.GetWordsWithTerm(term, fromLang, toLang)
+	ctx, cancel := handler.withTimeout(r, handler.config.GetAutocompleteTimeout())
+	defer cancel()
+	result, err := handler.repo.GetWordsWithTerm(ctx, term, fromLang, toLang)
 	if err != nil {
 		panic(err.Error())
 	}
+	handler.metrics.ObserveAutocomplete(fromLang, toLang, len(result))
+	ip := r.Header.Get("X-Real-IP")
+	if ip != "" {
+		ip = hostIP(ip)
+	}
+	if handler.bots.Known(r, ip+r.UserAgent()) == "" {
+		handler.stats.NotifyCounter(counterAutocomplete, fromLang[:3]+toLang[:3])
+	}
 	enc := json.NewEncoder(w)
 	numResults := len(result)
 	// limit autocomplete results to 10
@@ -306,37 +313,52 @@ func (handler WebserviceHandler) Autocomplete(w http.ResponseWriter, r *http.Req
 	enc.Encode(result[:numResults])
 }
 
+// Notify stores a suggestion for a word missing from the dictionary, posted
+// as the word and langkey form values. Only words suggested for the first
+// time are notified.
 func (handler WebserviceHandler) Notify(w http.ResponseWriter, r *http.Request) {
-	fromLang, toLang := handler.getLanguagesFromRequest(r.FormValue("langkey"))
-	term := r.FormValue("word")
+	fromLang, toLang := handler.getLanguagesFromRequest(r.Context(), r.FormValue("langkey"))
+	term := strings.TrimSpace(r.FormValue("word"))
 	if term == "" {
 		panic("No word inserted")
 	}
-	message := "Word: " + term + "\nDictionary: " + fromLang + "-" + toLang
-	go func() {
-		err := handler.msgutils.SendToSlack("Suggestion received: " + message)
-		if err != nil {
-			log.Info(err.Error())
-		}
-	}()
+	if len(term) > maxSuggestionLength {
+		panic("Word too long")
+	}
+	ip := handler.ips.Anonymize(clientIP(r))
+	suggestion, err := handler.repo.AddSuggestion(r.Context(), term, fromLang, toLang, ip,
+		handler.config.GetSuggestionsPerHour())
+	if err == ErrRateLimited {
+		utils.Logger(r.Context()).Warnf("Too many suggestions from %s", ip)
+		http.Error(w, "Too many suggestions, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	if suggestion.Count > 1 {
+		return
+	}
+	handler.notifier.Enqueue(r.Context(), EventSuggestion, "Suggestion received",
+		"Word: "+term+"\nDictionary: "+fromLang+"-"+toLang)
 }
 
-func (handler WebserviceHandler) getLanguagesFromRequest(key string) (string, string) {
+func (handler WebserviceHandler) getLanguagesFromRequest(ctx context.Context, key string) (string, string) {
 	if len(key) != 6 {
 		panic("Invalid key")
 	}
-	fromLang := handler.repo.GetLangFromKey(key[0:3])
-	toLang := handler.repo.GetLangFromKey(key[3:6])
+	fromLang := handler.repo.GetLangFromKey(ctx, key[0:3])
+	toLang := handler.repo.GetLangFromKey(ctx, key[3:6])
 	if fromLang == "" || toLang == "" {
 		panic("Invalid language keys")
 	}
 	return fromLang, toLang
 }
 
-func (handler WebserviceHandler) getBaseLanguage(key string) string {
+func (handler WebserviceHandler) getBaseLanguage(ctx context.Context, key string) string {
 	baseLang := "english"
 	if key != "" {
-		lang := handler.repo.GetLangFromKey(key)
+		lang := handler.repo.GetLangFromKey(ctx, key)
 		if lang != "" {
 			baseLang = lang
 		}
@@ -0,0 +1,224 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const (
+	auditPageLimit = 500
+	auditTimeout   = 5 * time.Second
+)
+
+// auditActions are the actions offered as filters in the audit page.
+var auditActions = []string{"deploy-front", "deploy-db", "deploy-cal", "edit-web", "edit-entry",
+	"create-token", "revoke-token", "moderate-suggestion", "resolve-feedback"}
+
+type auditKey struct{}
+
+// Audit writes an audit record of every call to the wrapped handler, which
+// should be an administrative one. It goes before Authorize, so that
+// rejected attempts are recorded as well, but only those presenting
+// credentials: anyone can make anonymous requests, and they would flood the
+// audit log.
+func (handler WebserviceHandler) Audit(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			record := &AuditRecord{Action: action, Ip: clientIP(r)}
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				// a panic is turned into a 500 by RecoverHandler further out
+				if err := recover(); err != nil {
+					record.Error = fmt.Sprintf("%v", err)
+					handler.writeAudit(r, record, http.StatusInternalServerError)
+					panic(err)
+				}
+				handler.writeAudit(r, record, rec.status)
+			}()
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func (handler WebserviceHandler) writeAudit(r *http.Request, record *AuditRecord, status int) {
+	if status == http.StatusUnauthorized && r.Header.Get("Authorization") == "" {
+		return
+	}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		record.Outcome = AuditDenied
+	case record.Error != "" || status >= 400:
+		record.Outcome = AuditError
+	default:
+		record.Outcome = AuditOK
+	}
+	// the request context may already be cancelled
+	logger := utils.Logger(r.Context())
+	ctx, cancel := context.WithTimeout(utils.WithLogger(context.Background(), logger), auditTimeout)
+	defer cancel()
+	if err := handler.repo.AddAuditRecord(ctx, record); err != nil {
+		logger.Errorf("Cannot write audit record: %v", err)
+	}
+}
+
+// getAudit returns the record being built by Audit, or nil outside of it.
+func getAudit(r *http.Request) *AuditRecord {
+	record, _ := r.Context().Value(auditKey{}).(*AuditRecord)
+	return record
+}
+
+func auditError(r *http.Request, err error) {
+	if record := getAudit(r); record != nil {
+		record.Error = err.Error()
+	}
+}
+
+// auditUpload records the sha256 and size of an uploaded file, then rewinds it.
+func auditUpload(r *http.Request, file multipart.File) error {
+	record := getAudit(r)
+	if record == nil {
+		return nil
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	record.FileHash, record.FileSize = hex.EncodeToString(hash.Sum(nil)), size
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+// clientIP returns the address of the client, as forwarded by the proxy in
+// X-Real-IP or else the remote address, without port.
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return hostIP(ip)
+	}
+	return hostIP(r.RemoteAddr)
+}
+
+// hostIP strips the port, if any, from an IPv4 or IPv6 address.
+func hostIP(addr string) string {
+	if net.ParseIP(addr) != nil {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+type AuditContent struct {
+	Actor    string
+	Action   string
+	Outcome  string
+	From     string
+	To       string
+	CsvUrl   template.URL
+	Actions  []string
+	Outcomes []string
+	Records  []*AuditRecord
+	Truncate bool
+}
+
+// getAuditFilter reads the actor, action, outcome, from and to (YYYY-MM-DD,
+// both inclusive) query parameters.
+func getAuditFilter(r *http.Request) (*AuditFilter, error) {
+	q := r.URL.Query()
+	filter := &AuditFilter{Actor: q.Get("actor"), Action: q.Get("action"), Outcome: q.Get("outcome")}
+	var err error
+	if q.Get("from") != "" {
+		if filter.From, err = time.ParseInLocation("2006-01-02", q.Get("from"), time.Local); err != nil {
+			return nil, fmt.Errorf("invalid date %s", q.Get("from"))
+		}
+	}
+	if q.Get("to") != "" {
+		if filter.To, err = time.ParseInLocation("2006-01-02", q.Get("to"), time.Local); err != nil {
+			return nil, fmt.Errorf("invalid date %s", q.Get("to"))
+		}
+		filter.To = filter.To.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+func (handler WebserviceHandler) AuditHTML(w http.ResponseWriter, r *http.Request) {
+	filter, err := getAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = auditPageLimit + 1
+	records, err := handler.repo.GetAuditRecords(r.Context(), filter)
+	if err != nil {
+		panic(err)
+	}
+	q := r.URL.Query()
+	content := &AuditContent{Actor: filter.Actor, Action: filter.Action, Outcome: filter.Outcome,
+		From: q.Get("from"), To: q.Get("to"), Records: records, Actions: auditActions,
+		Outcomes: []string{AuditOK, AuditError, AuditDenied}}
+	// the query was parsed and re-encoded, so it is safe in a link
+	content.CsvUrl = template.URL("/admin/audit.csv?" + q.Encode())
+	if len(records) > auditPageLimit {
+		content.Records, content.Truncate = records[:auditPageLimit], true
+	}
+	t := template.Must(template.New("audit.html").Funcs(template.FuncMap{"formatCounts": formatCounts}).
+		ParseFiles(handler.config.GetHTTPDir() + "audit.html"))
+	t.Execute(w, content)
+}
+
+// AuditCSV exports all the records matching the same filters as AuditHTML.
+func (handler WebserviceHandler) AuditCSV(w http.ResponseWriter, r *http.Request) {
+	filter, err := getAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := handler.repo.GetAuditRecords(r.Context(), filter)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "actor", "ip", "action", "outcome", "error", "file_hash", "file_size", "row_counts"})
+	for _, record := range records {
+		size := ""
+		if record.FileSize > 0 {
+			size = strconv.FormatInt(record.FileSize, 10)
+		}
+		writer.Write([]string{record.Time.Format(time.RFC3339), record.Actor, record.Ip, record.Action,
+			record.Outcome, record.Error, record.FileHash, size, formatCounts(record.RowCounts)})
+	}
+	writer.Flush()
+}
+
+// formatCounts lists row counts as "table=n" sorted by table name.
+func formatCounts(counts map[string]int) string {
+	tables := make([]string, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	parts := make([]string, len(tables))
+	for i, table := range tables {
+		parts[i] = fmt.Sprintf("%s=%d", table, counts[table])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// known crawlers come first, so that they are counted under their own name
+// rather than under a generic pattern
+var botUserAgents = []string{
+	"googlebot", "bingbot", "yandex", "baiduspider", "duckduckbot", "applebot",
+	"ahrefsbot", "semrushbot", "mj12bot", "dotbot", "petalbot", "bytespider",
+	"gptbot", "ccbot", "facebookexternalhit", "twitterbot", "slurp",
+	"curl", "wget", "python-requests", "python-urllib", "go-http-client",
+	"java/", "okhttp", "libwww", "httpclient", "scrapy", "headlesschrome",
+	"phantomjs", "lighthouse", "pingdom", "uptimerobot",
+	"bot", "crawl", "spider", "preview", "fetch",
+}
+
+// reasons for classifying a client as a bot, besides its user agent
+const (
+	botNoAgent   = "no-agent"
+	botNoHeaders = "no-headers"
+	botRate      = "rate"
+	botRobots    = "robots.txt"
+)
+
+const defaultRobotsTxt = "User-agent: *\nDisallow: /admin/\nDisallow: /services/\n"
+
+// BotClassifier tells crawlers and scripts from human visitors. A client is
+// a bot if its user agent looks like one, if it does not send the headers
+// every browser sends, or if it fetched robots.txt or made too many requests
+// in a minute today.
+type BotClassifier struct {
+	mutex        sync.Mutex
+	patterns     []string
+	maxPerMinute int
+	minute       time.Time
+	hits         map[string]int
+	day          time.Time
+	flagged      map[string]string
+}
+
+func NewBotClassifier(extra []string, maxPerMinute int) *BotClassifier {
+	patterns := make([]string, 0, len(extra)+len(botUserAgents))
+	for _, p := range extra {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	patterns = append(patterns, botUserAgents...)
+	return &BotClassifier{patterns: patterns, maxPerMinute: maxPerMinute,
+		hits: make(map[string]int), flagged: make(map[string]string)}
+}
+
+// Classify returns why the client identified by key is a bot, or an empty
+// string if it looks human.
+func (b *BotClassifier) Classify(r *http.Request, key string) string {
+	return b.classify(r, key, true)
+}
+
+// Known is Classify for requests that should not count towards the rate
+// of the client, such as the autocompletions sent while typing.
+func (b *BotClassifier) Known(r *http.Request, key string) string {
+	return b.classify(r, key, false)
+}
+
+func (b *BotClassifier) classify(r *http.Request, key string, count bool) string {
+	agent := strings.ToLower(r.UserAgent())
+	if agent == "" {
+		return botNoAgent
+	}
+	for _, p := range b.patterns {
+		if strings.Contains(agent, p) {
+			return p
+		}
+	}
+
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if day := now.Truncate(24 * time.Hour); !day.Equal(b.day) {
+		b.day = day
+		b.flagged = make(map[string]string)
+	}
+	if reason, ok := b.flagged[key]; ok {
+		return reason
+	}
+	if count && r.URL.Path == "/robots.txt" {
+		b.flagged[key] = botRobots
+		return botRobots
+	}
+	if r.Header.Get("Accept") == "" || r.Header.Get("Accept-Language") == "" {
+		return botNoHeaders
+	}
+	if !count {
+		return ""
+	}
+	if minute := now.Truncate(time.Minute); !minute.Equal(b.minute) {
+		b.minute = minute
+		b.hits = make(map[string]int)
+	}
+	b.hits[key]++
+	if b.maxPerMinute > 0 && b.hits[key] > b.maxPerMinute {
+		b.flagged[key] = botRate
+		return botRate
+	}
+	return ""
+}
+
+// RobotsTxt serves robots.txt from the frontend folder, or a default keeping
+// crawlers out of the services and admin pages. It is routed through
+// StatsHandler so that the clients fetching it are flagged as bots.
+func (handler WebserviceHandler) RobotsTxt(w http.ResponseWriter, r *http.Request) {
+	path := handler.config.GetHTTPDir() + "robots.txt"
+	if _, err := os.Stat(path); err == nil {
+		http.ServeFile(w, r, path)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(defaultRobotsTxt))
+}
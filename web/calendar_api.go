@@ -0,0 +1,137 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+const (
+	// without to, events are listed for this many days from the start
+	defaultEventsDays = 90
+	// bounds the expansion of recurring events
+	maxEventsDays = 2 * 366
+	// and so do the dates that can be listed
+	minEventsYear  = 1900
+	maxEventsYear  = 2199
+	defaultEvents  = 50
+	maxEvents      = 500
+	maxEventsQuery = 100
+)
+
+// EventJSON is a calendar event, or an occurrence of a recurring one, as
+// served by the events API. Dates are YYYY-MM-DD, end included, and the
+// description is HTML.
+type EventJSON struct {
+	Id          int64  `json:"id"`
+	UID         string `json:"uid,omitempty"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Tag         string `json:"tag"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Recurrence  string `json:"recurrence,omitempty"`
+	URL         string `json:"url"`
+}
+
+// EventsPage is a page of events. Next is the URL of the following page,
+// empty on the last one.
+type EventsPage struct {
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Next   string       `json:"next,omitempty"`
+	Events []*EventJSON `json:"events"`
+}
+
+// getEventsFilter reads the from and to (YYYY-MM-DD, both included), tag and
+// q query parameters. from defaults to today and to to 90 days later. The
+// range may not be wider than two years, nor leave the years allowed.
+func getEventsFilter(r *http.Request) (*CalendarFilter, error) {
+	q := r.URL.Query()
+	y, m, d := time.Now().Date()
+	filter := &CalendarFilter{From: time.Date(y, m, d, 0, 0, 0, 0, time.UTC),
+		Tag: strings.TrimSpace(q.Get("tag")), Query: strings.TrimSpace(q.Get("q"))}
+	var err error
+	if q.Get("from") != "" {
+		if filter.From, err = time.Parse("2006-01-02", q.Get("from")); err != nil {
+			return nil, fmt.Errorf("invalid date %s", q.Get("from"))
+		}
+	}
+	filter.To = filter.From.AddDate(0, 0, defaultEventsDays-1)
+	if q.Get("to") != "" {
+		if filter.To, err = time.Parse("2006-01-02", q.Get("to")); err != nil {
+			return nil, fmt.Errorf("invalid date %s", q.Get("to"))
+		}
+	}
+	if filter.From.Year() < minEventsYear || filter.To.Year() > maxEventsYear {
+		return nil, fmt.Errorf("only events from %d to %d can be listed", minEventsYear, maxEventsYear)
+	}
+	if filter.To.Before(filter.From) {
+		return nil, fmt.Errorf("to is before from")
+	}
+	if filter.To.Sub(filter.From) >= maxEventsDays*24*time.Hour {
+		return nil, fmt.Errorf("at most %d days can be listed", maxEventsDays)
+	}
+	if len(filter.Query) > maxEventsQuery {
+		return nil, fmt.Errorf("q is longer than %d characters", maxEventsQuery)
+	}
+	return filter, nil
+}
+
+// getPage reads the offset and limit query parameters, defaulting to the
+// first 50 events.
+func getPage(r *http.Request) (offset, limit int) {
+	offset, err := strconv.Atoi(r.FormValue("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err = strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 || limit > maxEvents {
+		limit = defaultEvents
+	}
+	return
+}
+
+// EventsJSON lists the events overlapping a range of days, optionally with a
+// tag or containing a text, so that other sites can embed them. Recurring
+// events are listed once per occurrence.
+func (handler WebserviceHandler) EventsJSON(w http.ResponseWriter, r *http.Request) {
+	filter, err := getEventsFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, limit := getPage(r)
+	ctx, cancel := handler.withTimeout(r, handler.config.GetCalendarTimeout())
+	defer cancel()
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	events, err := handler.repo.GetCalendarRange(ctx, filter, baseLang)
+	if err != nil {
+		panic(err)
+	}
+	page := &EventsPage{From: filter.From.Format("2006-01-02"), To: filter.To.Format("2006-01-02"),
+		Total: len(events), Offset: offset, Limit: limit, Events: make([]*EventJSON, 0, limit)}
+	base := baseURL(r)
+	for i := offset; i < len(events) && i < offset+limit; i++ {
+		e := events[i]
+		page.Events = append(page.Events, &EventJSON{Id: e.Id, UID: e.UID, Start: e.StartDate.Format("2006-01-02"),
+			End: e.EndDate.Format("2006-01-02"), Tag: e.Tag, Title: e.Title, Description: e.Description,
+			Recurrence: e.Recurrence, URL: calendarURL(base, e.StartDate, baseLang)})
+	}
+	if offset+limit < len(events) {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(offset+limit))
+		q.Set("limit", strconv.Itoa(limit))
+		next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		page.Next = base + next.String()
+	}
+	writeJSON(w, page)
+}
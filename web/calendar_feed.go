@@ -0,0 +1,93 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/ical"
+)
+
+const (
+	calendarFeedRefresh = 12 * time.Hour
+	// events that ended longer ago are left out of the feeds
+	calendarFeedPastYears = 1
+)
+
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+// htmlToText turns the HTML descriptions of the events into plain text.
+func htmlToText(s string) string {
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n").Replace(s)
+	return strings.TrimSpace(html.UnescapeString(htmlTags.ReplaceAllString(s, "")))
+}
+
+func baseURL(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// CalendarICS serves the events as an iCalendar feed, all of them on
+// /calendar.ics or those with a tag on /calendar/tag/:tag.ics.
+func (handler WebserviceHandler) CalendarICS(w http.ResponseWriter, r *http.Request) {
+	ps := getParams(r)
+	var tag string
+	if ps.ByName("year") == "tag" {
+		if !strings.HasSuffix(ps.ByName("month"), ".ics") {
+			http.NotFound(w, r)
+			return
+		}
+		tag = strings.TrimSuffix(ps.ByName("month"), ".ics")
+	}
+	ctx, cancel := handler.withTimeout(r, handler.config.GetCalendarTimeout())
+	defer cancel()
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	events, err := handler.repo.GetCalendarFeed(ctx, tag, time.Now().AddDate(-calendarFeedPastYears, 0, 0), baseLang)
+	if err != nil {
+		panic(err)
+	}
+	name := "AZ Jewels calendar"
+	if tag != "" {
+		name += " - " + tag
+	}
+	calendar := &ical.Calendar{ProdID: "-//AZ Jewels//Calendar//EN", Name: name,
+		RefreshInterval: calendarFeedRefresh, Events: make([]*ical.Event, len(events))}
+	host := strings.Split(r.Host, ":")[0]
+	for i, e := range events {
+		calendar.Events[i] = calendarFeedEvent(e, host, baseURL(r), baseLang)
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="calendar.ics"`)
+	if err = calendar.Encode(w); err != nil {
+		panic(err)
+	}
+}
+
+// calendarURL links to the calendar page of the month of d, in lang.
+func calendarURL(base string, d time.Time, lang string) string {
+	return base + "/calendar/" + strconv.Itoa(d.Year()) + "/" + strconv.Itoa(int(d.Month())) + "?lang=" + lang[:3]
+}
+
+// calendarFeedEvent converts e. Imported events keep their UID, the others
+// get one from their id, which is stable across imports of the same
+// workbook.
+func calendarFeedEvent(e *CalendarEvent, host, base, lang string) *ical.Event {
+	uid := e.UID
+	if uid == "" {
+		uid = fmt.Sprintf("event-%d@%s", e.Id, host)
+	}
+	event := &ical.Event{UID: uid, Start: e.StartDate, End: e.EndDate,
+		Summary: e.Title, Description: htmlToText(e.Description),
+		Recurrence: e.Recurrence, Exceptions: e.Exceptions, URL: calendarURL(base, e.StartDate, lang)}
+	if e.Tag != "" {
+		event.Categories = []string{e.Tag}
+	}
+	return event
+}
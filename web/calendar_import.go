@@ -0,0 +1,89 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/ical"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const (
+	calendarMerge   = "merge"
+	calendarReplace = "replace"
+)
+
+// DeployCalICS imports the events of an iCalendar file. In merge mode, the
+// default, events with a known UID are updated and the others added; in
+// replace mode, the calendar and its translations are emptied first.
+func (handler WebserviceHandler) DeployCalICS(w http.ResponseWriter, r *http.Request, file io.Reader) {
+	logger := utils.Logger(r.Context())
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = calendarMerge
+	}
+	if mode != calendarMerge && mode != calendarReplace {
+		err := fmt.Errorf("unknown mode %q", mode)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error importing calendar file: %v", err)
+		return
+	}
+	parsed, err := ical.Parse(file)
+	if err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error reading calendar file: %v", err)
+		return
+	}
+	events := calendarEventsFromICS(parsed)
+	t1 := time.Now()
+	ctx, cancel := handler.importContext(r)
+	defer cancel()
+	counts, err := handler.repo.ImportCalendarEvents(ctx, events, mode == calendarReplace)
+	handler.metrics.ObserveImport("calendar", time.Since(t1), err)
+	if record := getAudit(r); record != nil {
+		record.RowCounts = counts
+	}
+	handler.notifyImport(r, "calendar", counts, err)
+	if err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error importing calendar: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// calendarEventsFromICS converts the parsed events, keeping the last one of
+// those sharing a UID. Events without UID get one from their content, so
+// that importing the same file twice does not duplicate them.
+func calendarEventsFromICS(parsed []*ical.Event) []*CalendarEvent {
+	events := make([]*CalendarEvent, 0, len(parsed))
+	byUID := make(map[string]int)
+	for _, e := range parsed {
+		event := &CalendarEvent{UID: e.UID, StartDate: e.Start, EndDate: e.End, Title: e.Summary,
+			Description: strings.Replace(html.EscapeString(e.Description), "\n", "<br>", -1),
+			Recurrence:  e.Recurrence, Exceptions: e.Exceptions}
+		if len(e.Categories) > 0 {
+			event.Tag = e.Categories[0]
+		}
+		if event.UID == "" {
+			sum := sha256.Sum256([]byte(e.Start.Format("20060102") + "|" + e.End.Format("20060102") + "|" + e.Summary))
+			event.UID = hex.EncodeToString(sum[:16]) + "@ics-import"
+		}
+		if i, ok := byUID[event.UID]; ok {
+			events[i] = event
+			continue
+		}
+		byUID[event.UID] = len(events)
+		events = append(events, event)
+	}
+	return events
+}
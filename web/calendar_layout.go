@@ -0,0 +1,70 @@
+package web
+
+import (
+	"html/template"
+	"math"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+// calendarHeaderRows are the grid rows above the first week, the day names.
+const calendarHeaderRows = 1
+
+// daysBetween returns the number of days from a to b, whatever their time
+// zones.
+func daysBetween(a, b time.Time) int {
+	ya, ma, da := a.Date()
+	yb, mb, db := b.Date()
+	return int(math.Round(time.Date(yb, mb, db, 0, 0, 0, 0, time.UTC).
+		Sub(time.Date(ya, ma, da, 0, 0, 0, 0, time.UTC)).Hours() / 24))
+}
+
+// layoutEvents places the events on a grid of weeks rows of seven days,
+// starting on the day first. Events running over several weeks are split
+// into one piece per week, and the pieces following the first, or starting
+// before the grid, are continuations. Pieces sharing days in a week get
+// increasing levels, as many as needed, so that they do not overlap.
+func layoutEvents(events []*CalendarEvent, first time.Time, weeks int) []CalendarEventHtml {
+	last := 7*weeks - 1
+	placed := make([]CalendarEventHtml, 0, len(events))
+	for _, e := range events {
+		from, to := daysBetween(first, e.StartDate), daysBetween(first, e.EndDate)
+		if to < 0 || from > last || to < from {
+			continue
+		}
+		continuation := from < 0
+		if from < 0 {
+			from = 0
+		}
+		if to > last {
+			to = last
+		}
+		for from <= to {
+			week := from / 7
+			end := week*7 + 6
+			if end > to {
+				end = to
+			}
+			placed = append(placed, CalendarEventHtml{Id: len(placed) + 1, Tag: e.Tag, Title: e.Title,
+				Description: template.HTML(e.Description), Row: week + calendarHeaderRows + 1, Column: from%7 + 1,
+				Span: end - from + 1, IsContinuation: continuation})
+			continuation = true
+			from = end + 1
+		}
+	}
+
+	for i := range placed {
+		taken := make(map[int]bool)
+		for j := 0; j < i; j++ {
+			if placed[i].Row == placed[j].Row && placed[i].Column < placed[j].Column+placed[j].Span &&
+				placed[j].Column < placed[i].Column+placed[i].Span {
+				taken[placed[j].Level] = true
+			}
+		}
+		for taken[placed[i].Level] {
+			placed[i].Level++
+		}
+	}
+	return placed
+}
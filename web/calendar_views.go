@@ -0,0 +1,251 @@
+package web
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+)
+
+// the agenda lists the events of this many days per page
+const agendaDays = 90
+
+// CalendarNav links the calendar views to each other, around the day shown.
+type CalendarNav struct {
+	LangTag string
+	// View is month, week, agenda or year
+	View  string
+	Year  int
+	Month int
+	// Week is the Monday (YYYY-MM-DD) of the week shown
+	Week string
+}
+
+func calendarNav(lang, view string, d time.Time) *CalendarNav {
+	return &CalendarNav{LangTag: lang[:3], View: view, Year: d.Year(), Month: int(d.Month()),
+		Week: monday(d).Format("2006-01-02")}
+}
+
+func monday(d time.Time) time.Time {
+	return d.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+}
+
+func todayUTC() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// calendarTemplate parses a calendar page together with the navigation
+// between the views, calendar_nav.html.
+func (handler WebserviceHandler) calendarTemplate(ctx context.Context, name, baseLang string) *template.Template {
+	dir := handler.config.GetHTTPDir()
+	return template.Must(template.New(name).Funcs(handler.getHelpers(ctx, baseLang)).
+		ParseFiles(dir+name, dir+"calendar_nav.html"))
+}
+
+func (handler WebserviceHandler) weekdayNames(ctx context.Context, lang string) []string {
+	names := make([]string, len(WEEKDAYS))
+	for i, name := range WEEKDAYS {
+		names[i] = handler.webString(ctx, lang, "weekday_"+strconv.Itoa(i+1), name)
+	}
+	return names
+}
+
+func (handler WebserviceHandler) monthName(ctx context.Context, lang string, month int) string {
+	return handler.webString(ctx, lang, "month_"+strconv.Itoa(month), MONTHS[month-1])
+}
+
+// dayLabel formats d as e.g. "Mon 19 October 2026", in lang.
+func (handler WebserviceHandler) dayLabel(ctx context.Context, lang string, d time.Time) string {
+	return handler.webString(ctx, lang, "weekday_"+strconv.Itoa((int(d.Weekday())+6)%7+1), WEEKDAYS[(int(d.Weekday())+6)%7]) +
+		" " + strconv.Itoa(d.Day()) + " " + handler.monthName(ctx, lang, int(d.Month())) + " " + strconv.Itoa(d.Year())
+}
+
+type CalendarWeekContent struct {
+	LangTag  string
+	Title    string
+	Weekdays []string
+	Days     []CalendarDay
+	Prev     string
+	Next     string
+	Events   []CalendarEventHtml
+	Nav      *CalendarNav
+}
+
+// CalendarWeekHTML shows the week of the day /calendar/week/:date
+// (YYYY-MM-DD), or the current week on /calendar/week. Each level of
+// overlapping events gets its own row.
+func (handler WebserviceHandler) CalendarWeekHTML(w http.ResponseWriter, r *http.Request) {
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	d := todayUTC()
+	if date := getParams(r).ByName("month"); date != "" {
+		var err error
+		if d, err = time.Parse("2006-01-02", date); err != nil {
+			http.Error(w, "invalid date "+date, http.StatusBadRequest)
+			return
+		}
+	}
+	first := monday(d)
+	last := first.AddDate(0, 0, 6)
+	ctx, cancel := handler.withTimeout(r, handler.config.GetCalendarTimeout())
+	defer cancel()
+	events, err := handler.repo.GetCalendarRange(ctx, &CalendarFilter{From: first, To: last}, baseLang)
+	if err != nil {
+		panic(err)
+	}
+	html_events := layoutEvents(events, first, 1)
+	for i := range html_events {
+		html_events[i].Row += html_events[i].Level
+	}
+
+	today := todayUTC()
+	days := make([]CalendarDay, 7)
+	for i := range days {
+		day := first.AddDate(0, 0, i)
+		days[i] = CalendarDay{Day: day.Day(), Active: true, IsToday: day.Equal(today)}
+	}
+	title := strconv.Itoa(first.Day())
+	if first.Month() != last.Month() {
+		title += " " + handler.monthName(r.Context(), baseLang, int(first.Month()))
+	}
+	if first.Year() != last.Year() {
+		title += " " + strconv.Itoa(first.Year())
+	}
+	title += " - " + strconv.Itoa(last.Day()) + " " + handler.monthName(r.Context(), baseLang, int(last.Month())) +
+		" " + strconv.Itoa(last.Year())
+
+	content := &CalendarWeekContent{LangTag: baseLang[:3], Title: title, Weekdays: handler.weekdayNames(r.Context(), baseLang),
+		Days: days, Prev: first.AddDate(0, 0, -7).Format("2006-01-02"), Next: first.AddDate(0, 0, 7).Format("2006-01-02"),
+		Events: html_events, Nav: calendarNav(baseLang, "week", first)}
+	handler.calendarTemplate(r.Context(), "calendar_week.html", baseLang).Execute(w, content)
+}
+
+type AgendaEvent struct {
+	Dates       string
+	Tag         string
+	Title       string
+	Description template.HTML
+}
+
+type CalendarAgendaContent struct {
+	LangTag string
+	From    string
+	To      string
+	Tag     string
+	Prev    string
+	Next    string
+	Events  []*AgendaEvent
+	Nav     *CalendarNav
+}
+
+// CalendarAgendaHTML lists the events of the 90 days from the day ?from=
+// (YYYY-MM-DD), by default today, optionally only those with ?tag=.
+// Recurring events are listed once per occurrence.
+func (handler WebserviceHandler) CalendarAgendaHTML(w http.ResponseWriter, r *http.Request) {
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	filter := &CalendarFilter{From: todayUTC(), Tag: r.FormValue("tag")}
+	if from := r.FormValue("from"); from != "" {
+		var err error
+		if filter.From, err = time.Parse("2006-01-02", from); err != nil {
+			http.Error(w, "invalid date "+from, http.StatusBadRequest)
+			return
+		}
+	}
+	filter.To = filter.From.AddDate(0, 0, agendaDays-1)
+	ctx, cancel := handler.withTimeout(r, handler.config.GetCalendarTimeout())
+	defer cancel()
+	events, err := handler.repo.GetCalendarRange(ctx, filter, baseLang)
+	if err != nil {
+		panic(err)
+	}
+	agenda := make([]*AgendaEvent, len(events))
+	for i, e := range events {
+		dates := handler.dayLabel(r.Context(), baseLang, e.StartDate)
+		if daysBetween(e.StartDate, e.EndDate) > 0 {
+			dates += " - " + handler.dayLabel(r.Context(), baseLang, e.EndDate)
+		}
+		agenda[i] = &AgendaEvent{Dates: dates, Tag: e.Tag, Title: e.Title, Description: template.HTML(e.Description)}
+	}
+	content := &CalendarAgendaContent{LangTag: baseLang[:3], Tag: filter.Tag, Events: agenda,
+		From: handler.dayLabel(r.Context(), baseLang, filter.From), To: handler.dayLabel(r.Context(), baseLang, filter.To),
+		Prev: filter.From.AddDate(0, 0, -agendaDays).Format("2006-01-02"),
+		Next: filter.To.AddDate(0, 0, 1).Format("2006-01-02"), Nav: calendarNav(baseLang, "agenda", filter.From)}
+	handler.calendarTemplate(r.Context(), "calendar_agenda.html", baseLang).Execute(w, content)
+}
+
+type YearMonth struct {
+	Number int
+	Name   string
+	Days   []CalendarDay
+}
+
+type CalendarYearContent struct {
+	LangTag  string
+	Year     int
+	Prev     int
+	Next     int
+	Weekdays []string
+	Months   []*YearMonth
+	Nav      *CalendarNav
+}
+
+// CalendarYearHTML shows the months of /calendar/:year, marking the days
+// with events. The agenda and the current week share the route, as
+// /calendar/agenda and /calendar/week.
+func (handler WebserviceHandler) CalendarYearHTML(w http.ResponseWriter, r *http.Request) {
+	switch getParams(r).ByName("year") {
+	case "agenda":
+		handler.CalendarAgendaHTML(w, r)
+		return
+	case "week":
+		handler.CalendarWeekHTML(w, r)
+		return
+	}
+	year, err := strconv.Atoi(getParams(r).ByName("year"))
+	if err != nil || year < 1 || year > 9999 {
+		http.NotFound(w, r)
+		return
+	}
+	baseLang := handler.getBaseLanguage(r.Context(), r.FormValue("lang"))
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := handler.withTimeout(r, handler.config.GetCalendarTimeout())
+	defer cancel()
+	events, err := handler.repo.GetCalendarRange(ctx, &CalendarFilter{From: first, To: last}, baseLang)
+	if err != nil {
+		panic(err)
+	}
+	// events per day of the year
+	counts := make([]int, daysBetween(first, last)+1)
+	for _, e := range events {
+		from, to := daysBetween(first, e.StartDate), daysBetween(first, e.EndDate)
+		for d := from; d <= to; d++ {
+			if d >= 0 && d < len(counts) {
+				counts[d]++
+			}
+		}
+	}
+
+	today := todayUTC()
+	months := make([]*YearMonth, 12)
+	for m := range months {
+		start := time.Date(year, time.Month(m+1), 1, 0, 0, 0, 0, time.UTC)
+		month := &YearMonth{Number: m + 1, Name: handler.monthName(r.Context(), baseLang, m+1),
+			Days: make([]CalendarDay, (int(start.Weekday())+6)%7)}
+		for d := start; d.Month() == start.Month(); d = d.AddDate(0, 0, 1) {
+			month.Days = append(month.Days, CalendarDay{Day: d.Day(), Active: true, IsToday: d.Equal(today),
+				Date: d.Format("2006-01-02"), Events: counts[daysBetween(first, d)]})
+		}
+		months[m] = month
+	}
+	nav := calendarNav(baseLang, "year", first)
+	if year == today.Year() {
+		nav = calendarNav(baseLang, "year", today)
+	}
+	content := &CalendarYearContent{LangTag: baseLang[:3], Year: year, Prev: year - 1, Next: year + 1, Weekdays: handler.weekdayNames(r.Context(), baseLang),
+		Months: months, Nav: nav}
+	handler.calendarTemplate(r.Context(), "calendar_year.html", baseLang).Execute(w, content)
+}
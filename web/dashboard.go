@@ -0,0 +1,143 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// names of the counters kept by StatsTracker
+const (
+	counterAutocomplete = "autocomplete"
+	counterBaseLang     = "base_lang"
+	counterReferer      = "referer"
+	counterBot          = "bot"
+)
+
+const (
+	defaultStatsDays = 30
+	maxTopTerms      = 100
+)
+
+type TermCount struct {
+	Term string `json:"term"`
+	Hits int    `json:"hits"`
+}
+
+type KeyCount struct {
+	Key  string `json:"key"`
+	Hits int    `json:"hits"`
+}
+
+type Conversion struct {
+	LangPair     string  `json:"pair"`
+	Autocomplete int     `json:"autocomplete"`
+	Searches     int     `json:"searches"`
+	Rate         float64 `json:"rate"`
+}
+
+// getStatsPeriod reads the from and to query parameters (YYYY-MM-DD, both
+// included), defaulting to the last 30 days.
+func getStatsPeriod(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	to = today()
+	if q.Get("to") != "" {
+		if to, err = time.ParseInLocation("2006-01-02", q.Get("to"), time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid date %s", q.Get("to"))
+		}
+	}
+	from = to.AddDate(0, 0, 1-defaultStatsDays)
+	if q.Get("from") != "" {
+		if from, err = time.ParseInLocation("2006-01-02", q.Get("from"), time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid date %s", q.Get("from"))
+		}
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (handler WebserviceHandler) StatsHTML(w http.ResponseWriter, r *http.Request) {
+	t := template.Must(template.New("stats.html").ParseFiles(handler.config.GetHTTPDir() + "stats.html"))
+	t.Execute(w, nil)
+}
+
+// TopSearchesJSON returns the most searched terms per language pair. With
+// found=false, the terms that were not found are returned instead.
+func (handler WebserviceHandler) TopSearchesJSON(w http.ResponseWriter, r *http.Request) {
+	from, to, err := getStatsPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 || limit > maxTopTerms {
+		limit = 20
+	}
+	stats, err := handler.repo.GetTopSearches(r.Context(), from, to, r.FormValue("found") != "false", limit)
+	if err != nil {
+		panic(err)
+	}
+	pairs := make(map[string][]*TermCount)
+	for _, s := range stats {
+		pairs[s.LangPair] = append(pairs[s.LangPair], &TermCount{Term: s.Term, Hits: s.Hits})
+	}
+	writeJSON(w, pairs)
+}
+
+// ConversionJSON compares, per language pair, the autocomplete lookups with
+// the searches they led to.
+func (handler WebserviceHandler) ConversionJSON(w http.ResponseWriter, r *http.Request) {
+	from, to, err := getStatsPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lookups, err := handler.repo.GetCounterTotals(r.Context(), counterAutocomplete, from, to)
+	if err != nil {
+		panic(err)
+	}
+	searches, err := handler.repo.GetSearchTotals(r.Context(), from, to)
+	if err != nil {
+		panic(err)
+	}
+	conversions := make([]*Conversion, 0)
+	for pair, n := range lookups {
+		c := &Conversion{LangPair: pair, Autocomplete: n, Searches: searches[pair]}
+		if n > 0 {
+			c.Rate = float64(c.Searches) / float64(n)
+		}
+		conversions = append(conversions, c)
+	}
+	sort.Slice(conversions, func(i, j int) bool { return conversions[i].Autocomplete > conversions[j].Autocomplete })
+	writeJSON(w, conversions)
+}
+
+// counterJSON returns the totals of a counter, e.g. the page views per base
+// language (?lang=) or per referring host.
+func (handler WebserviceHandler) counterJSON(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := getStatsPeriod(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		totals, err := handler.repo.GetCounterTotals(r.Context(), name, from, to)
+		if err != nil {
+			panic(err)
+		}
+		counts := make([]*KeyCount, 0, len(totals))
+		for key, hits := range totals {
+			counts = append(counts, &KeyCount{Key: key, Hits: hits})
+		}
+		sort.Slice(counts, func(i, j int) bool { return counts[i].Hits > counts[j].Hits })
+		writeJSON(w, counts)
+	}
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const maxFeedbackLength = 2000
+
+// SendFeedback stores a problem report on an entry. It expects the form
+// values lang (language tag), id (concept id), word, category and comment.
+func (handler WebserviceHandler) SendFeedback(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	lang := handler.repo.GetLangFromKey(r.Context(), r.FormValue("lang"))
+	if lang == "" {
+		http.Error(w, "Invalid language", http.StatusBadRequest)
+		return
+	}
+	conceptId, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	category := r.FormValue("category")
+	if !utils.Contains(FeedbackCategories, category) {
+		http.Error(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	comment := strings.TrimSpace(r.FormValue("comment"))
+	if len(comment) > maxFeedbackLength {
+		http.Error(w, "Comment too long", http.StatusBadRequest)
+		return
+	}
+
+	ip := handler.ips.Anonymize(clientIP(r))
+	f := &Feedback{ConceptId: conceptId, Lang: lang, Word: r.FormValue("word"), Category: category,
+		Comment: comment, Ip: ip}
+	err = handler.repo.AddFeedback(r.Context(), f, handler.config.GetFeedbackPerHour())
+	if err == ErrRateLimited {
+		logger.Warnf("Too many feedback reports from %s", ip)
+		http.Error(w, "Too many reports, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		logger.Warnf("%s", err)
+		fmt.Fprintf(w, "Error sending feedback: %v", err)
+		return
+	}
+	logger.Infof("Feedback %d (%s) on %s (%d) in %s", f.Id, category, f.Word, conceptId, lang)
+	fmt.Fprintf(w, "OK")
+}
+
+type FeedbackContent struct {
+	Feedback []*Feedback
+}
+
+func (handler WebserviceHandler) FeedbackHTML(w http.ResponseWriter, r *http.Request) {
+	feedback, err := handler.repo.GetOpenFeedback(r.Context(), "", 0)
+	if err != nil {
+		panic(err)
+	}
+	t := template.Must(template.New("feedback.html").ParseFiles(handler.config.GetHTTPDir() + "feedback.html"))
+	t.Execute(w, &FeedbackContent{Feedback: feedback})
+}
+
+// FeedbackJSON returns the open reports on the entry given by the lang and
+// id query parameters, so that editors see them next to the entry.
+func (handler WebserviceHandler) FeedbackJSON(w http.ResponseWriter, r *http.Request) {
+	lang := handler.repo.GetLangFromKey(r.Context(), r.FormValue("lang"))
+	conceptId, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if lang == "" || err != nil {
+		http.Error(w, "Invalid language or id", http.StatusBadRequest)
+		return
+	}
+	feedback, err := handler.repo.GetOpenFeedback(r.Context(), lang, conceptId)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feedback)
+}
+
+func (handler WebserviceHandler) ResolveFeedback(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	id, err := strconv.ParseInt(getParams(r).ByName("id"), 10, 64)
+	if err != nil {
+		auditError(r, err)
+		fmt.Fprintf(w, "Error resolving feedback: invalid id %s", getParams(r).ByName("id"))
+		return
+	}
+	if err = handler.repo.ResolveFeedback(r.Context(), id); err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error resolving feedback: %v", err)
+		return
+	}
+	logger.Infof("Feedback %d resolved", id)
+	if r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/admin/feedback", http.StatusSeeOther)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
@@ -2,69 +2,148 @@ package web
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
-	"github.com/gorilla/context"
-	"github.com/julienschmidt/httprouter"
-
 	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
 )
 
-func (handler WebserviceHandler) BasicAuth(next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		authError := func() {
-			log.Debug("Asking client to authenticate... setting header")
-			w.Header().Set("WWW-Authenticate", "Basic realm")
-			log.Debug("Sending error")
-			http.Error(w, "Authorization failed", http.StatusUnauthorized)
-		}
-		log.Debug("Checking authorization header")
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			authError()
-			return
-		}
-		log.Debug("Reading authorization header")
-		auth := strings.SplitN(authHeader, " ", 2)
-		if len(auth) != 2 || auth[0] != "Basic" {
-			authError()
-			return
+// withTimeout derives a context from the request that is cancelled when the
+// client goes away or after timeout, whichever comes first.
+func (handler WebserviceHandler) withTimeout(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// importContext returns a context for the imports, which must not be
+// cancelled when the uploader disconnects, as the caches are refreshed once
+// the transaction is committed. It keeps the request-scoped logger.
+func (handler WebserviceHandler) importContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := utils.WithLogger(context.Background(), utils.Logger(r.Context()))
+	if timeout := handler.config.GetImportTimeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Authorize only lets through requests authenticated as a user whose role
+// grants perm, or with a valid API token granting perm. The principal is
+// stored in the request context.
+func (handler WebserviceHandler) Authorize(perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			logger := utils.Logger(r.Context())
+			logger.Debug("Checking authorization header")
+			principal := handler.authenticate(r)
+			if principal == nil {
+				logger.Debug("Asking client to authenticate... setting header")
+				w.Header().Set("WWW-Authenticate", "Basic realm")
+				http.Error(w, "Authorization failed", http.StatusUnauthorized)
+				return
+			}
+			if record := getAudit(r); record != nil {
+				record.Actor = principal.Name
+			}
+			if !principal.Can(perm) {
+				logger.Warnf("%s (%s) is not allowed to %s", principal.Name, principal.Role, perm)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), principalKey{}, principal)
+			ctx = utils.WithLogger(ctx, logger.WithField("user", principal.Name))
+			next.ServeHTTP(w, r.WithContext(ctx))
 		}
-		log.Debug("Decoding password")
+		return http.HandlerFunc(fn)
+	}
+}
+
+// authenticate returns the principal of a request carrying either Basic
+// credentials or a Bearer token, or nil if they are missing or invalid.
+func (handler WebserviceHandler) authenticate(r *http.Request) *Principal {
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 {
+		return nil
+	}
+	switch auth[0] {
+	case "Bearer":
+		return handler.ValidateToken(r.Context(), strings.TrimSpace(auth[1]))
+	case "Basic":
 		payload, err := base64.StdEncoding.DecodeString(auth[1])
 		if err != nil {
-			authError()
-			return
+			return nil
 		}
-		log.Debug("Checking password")
 		pair := strings.SplitN(string(payload), ":", 2)
-		if len(pair) != 2 || !handler.ValidateAdmin(pair[0], pair[1]) {
-			authError()
-			return
+		if len(pair) != 2 {
+			return nil
 		}
+		return handler.ValidateAdmin(r.Context(), pair[0], pair[1])
+	}
+	return nil
+}
 
-		next.ServeHTTP(w, r)
+type principalKey struct{}
+
+// getPrincipal returns the identity stored by Authorize, if any.
+func getPrincipal(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// ValidateAdmin checks the credentials against the admin user store.
+// As long as the store is empty, the legacy "admin" user with ADMIN_PASS
+// is accepted, so that the first users can be created.
+func (handler WebserviceHandler) ValidateAdmin(ctx context.Context, username, password string) *Principal {
+	user, err := handler.repo.GetUser(ctx, username)
+	if err != nil {
+		utils.Logger(ctx).Warnf("Cannot read admin users: %v", err)
+		return nil
 	}
-	return http.HandlerFunc(fn)
+	if user != nil {
+		if utils.CheckPassword(user.PasswordHash, password) {
+			return &Principal{Name: user.Username, Role: user.Role}
+		}
+		return nil
+	}
+	adminPass := handler.config.GetAdminPass()
+	if username == "admin" && adminPass != "" && password == adminPass {
+		if count, err := handler.repo.CountUsers(ctx); err == nil && count == 0 {
+			utils.Logger(ctx).Warn("Legacy ADMIN_PASS login, create admin users with dictctl")
+			return &Principal{Name: username, Role: RoleAdmin}
+		}
+	}
+	return nil
 }
 
-func (handler WebserviceHandler) ValidateAdmin(username, password string) bool {
-	if username == "admin" && password == handler.config.GetAdminPass() {
-		return true
+// ValidateToken returns a principal holding the permissions of the token,
+// unless it is unknown, revoked or expired.
+func (handler WebserviceHandler) ValidateToken(ctx context.Context, secret string) *Principal {
+	token, err := handler.repo.GetTokenByHash(ctx, utils.HashToken(secret))
+	if err != nil {
+		utils.Logger(ctx).Warnf("Cannot read api tokens: %v", err)
+		return nil
 	}
-	return false
+	if token == nil || !token.Valid(time.Now()) {
+		return nil
+	}
+	return &Principal{Name: fmt.Sprintf("token:%d:%s", token.Id, token.Name), Permissions: token.Permissions}
 }
 
 func (handler WebserviceHandler) RecoverHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Warnf("%v", err)
+				utils.Logger(r.Context()).Warnf("%v", err)
 				http.Error(w, http.StatusText(500)+": "+fmt.Sprintf("%v", err), 500)
 			}
 		}()
@@ -74,38 +153,85 @@ func (handler WebserviceHandler) RecoverHandler(next http.Handler) http.Handler
 	return http.HandlerFunc(fn)
 }
 
+// RequestIDHandler tags the request with an id, taken from the X-Request-ID
+// header if the proxy set one, and stores a logger carrying it in the context.
+func (handler WebserviceHandler) RequestIDHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = utils.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		logger := log.WithField("request_id", id)
+		next.ServeHTTP(w, r.WithContext(utils.WithLogger(r.Context(), logger)))
+	}
+	return http.HandlerFunc(fn)
+}
+
 func (handler WebserviceHandler) LoggingHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		//useful to test the frontend locally, remove in prod
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 		t1 := time.Now()
-		next.ServeHTTP(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
 		t2 := time.Now()
-		log.Infof("%s request to %q: time %v", r.Method, r.URL.String(), t2.Sub(t1))
+		utils.Logger(r.Context()).WithFields(log.Fields{"method": r.Method, "uri": r.URL.String(),
+			"status": rec.status, "duration": t2.Sub(t1)}).Infof("%s request to %q", r.Method, r.URL.String())
 	}
 	return http.HandlerFunc(fn)
 }
 
+// StatsHandler counts visits, unless the client asks not to be tracked, and
+// searches on the search route. Requests from bots are only counted per bot,
+// and left out of everything else. A search is
+// found unless it ends in an error; redirections to the reversed dictionary
+// are counted when the redirected request comes back, and searches that
+// timed out are not counted.
 func (handler WebserviceHandler) StatsHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
 		//ip := strings.Split(r.RemoteAddr, ":")[0]
 		ip := r.Header.Get("X-Real-IP")
 		if ip != "" {
-			ip = strings.Split(ip, ":")[0]
+			ip = hostIP(ip)
 		}
-		key := ip + r.UserAgent()
-		ps := context.Get(r, "params").(httprouter.Params)
+		ps := getParams(r)
 		term := ps.ByName("term")
 		agent := r.UserAgent()
-		if len(r.RequestURI) > 1 && !strings.Contains(r.RequestURI, "httpheader") && agent != "" {
-			go handler.stats.NotifyUser(&User{Ip: ip, Referer: r.Referer(),
-				UserAgent: agent, LastUri: r.RequestURI}, key, term)
+		if bot := handler.bots.Classify(r, ip+agent); bot != "" {
+			handler.stats.NotifyCounter(counterBot, bot)
+			return
+		}
+		if len(r.RequestURI) > 1 && !strings.Contains(r.RequestURI, "httpheader") {
+			if !handler.config.GetPrivacyHonourDNT() || !doNotTrack(r) {
+				handler.stats.NotifyUser(&User{Ip: ip, Referer: r.Referer(),
+					UserAgent: agent, LastUri: r.RequestURI})
+				if referer, err := url.Parse(r.Referer()); err == nil && referer.Host != "" && referer.Host != r.Host {
+					handler.stats.NotifyCounter(counterReferer, referer.Host)
+				}
+			}
+			handler.stats.NotifyCounter(counterBaseLang, handler.getBaseLanguage(r.Context(), r.FormValue("lang"))[:3])
+		}
+		langKey := ps.ByName("langkey")
+		if term != "" && len(term) <= maxSuggestionLength && rec.status != http.StatusFound &&
+			rec.status != http.StatusGatewayTimeout && len(langKey) == 6 &&
+			handler.repo.GetLangFromKey(r.Context(), langKey[:3]) != "" &&
+			handler.repo.GetLangFromKey(r.Context(), langKey[3:]) != "" {
+			handler.stats.NotifySearch(langKey, term, rec.status < 400)
 		}
 	}
 	return http.HandlerFunc(fn)
 }
 
+// doNotTrack tells if the client opted out of tracking. Neither the visit nor
+// the page that linked to us are counted, but anonymous counts, like the
+// searched terms and the language of the site, are still kept.
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
 type gzipResponseWriter struct {
 	io.Writer
 	http.ResponseWriter
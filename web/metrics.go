@@ -0,0 +1,107 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the prometheus collectors exposed on /metrics.
+// Each handler has its own registry, so that several can coexist in tests.
+type Metrics struct {
+	registry            *prometheus.Registry
+	requestDuration     *prometheus.HistogramVec
+	searches            *prometheus.CounterVec
+	autocompleteResults *prometheus.HistogramVec
+	importDuration      *prometheus.HistogramVec
+}
+
+func NewMetrics(repo Repository) *Metrics {
+	m := &Metrics{registry: prometheus.NewRegistry()}
+	ctx := context.Background()
+	m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "dictionary_http_request_duration_seconds",
+		Help: "Latency of the dynamic routes.",
+	}, []string{"route", "method", "status"})
+	// result is "hit", "miss" or "reversed" when the word was only found
+	// in the opposite dictionary and the client was redirected
+	m.searches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dictionary_searches_total",
+		Help: "Searches per language pair and result.",
+	}, []string{"pair", "result"})
+	m.autocompleteResults = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dictionary_autocomplete_results",
+		Help:    "Number of words matching an autocomplete term.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 500, 1000},
+	}, []string{"pair"})
+	m.importDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dictionary_import_duration_seconds",
+		Help:    "Duration of database and calendar imports.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"kind", "outcome"})
+
+	m.registry.MustRegister(m.requestDuration, m.searches, m.autocompleteResults, m.importDuration,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	gauge := func(name, help string, f func() float64) {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f))
+	}
+	gauge("dictionary_db_open_connections", "Open connections to the database.", func() float64 {
+		return float64(repo.GetDBStats(ctx).OpenConnections)
+	})
+	gauge("dictionary_db_in_use_connections", "Connections currently in use.", func() float64 {
+		return float64(repo.GetDBStats(ctx).InUse)
+	})
+	gauge("dictionary_db_idle_connections", "Idle connections.", func() float64 {
+		return float64(repo.GetDBStats(ctx).Idle)
+	})
+	gauge("dictionary_db_wait_count", "Total number of connections waited for.", func() float64 {
+		return float64(repo.GetDBStats(ctx).WaitCount)
+	})
+	gauge("dictionary_db_wait_duration_seconds", "Total time spent waiting for a connection.", func() float64 {
+		return repo.GetDBStats(ctx).WaitDuration.Seconds()
+	})
+	gauge("dictionary_cached_words", "Words held in the autocomplete cache.", func() float64 {
+		return float64(repo.GetCachedWordsCount(ctx))
+	})
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) ObserveRequest(route, method string, status int, d time.Duration) {
+	m.requestDuration.WithLabelValues(route, method, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+func (m *Metrics) CountSearch(fromLang, toLang, result string) {
+	m.searches.WithLabelValues(fromLang[:3]+toLang[:3], result).Inc()
+}
+
+func (m *Metrics) ObserveAutocomplete(fromLang, toLang string, results int) {
+	m.autocompleteResults.WithLabelValues(fromLang[:3] + toLang[:3]).Observe(float64(results))
+}
+
+func (m *Metrics) ObserveImport(kind string, d time.Duration, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.importDuration.WithLabelValues(kind, outcome).Observe(d.Seconds())
+}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
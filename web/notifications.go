@@ -0,0 +1,131 @@
+package web
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const (
+	EventSuggestion = "suggestion"
+	EventImport     = "import"
+)
+
+const (
+	notificationInterval    = 30 * time.Second
+	notificationBatch       = 20
+	notificationMaxAttempts = 12
+	notificationMaxBackoff  = 6 * time.Hour
+)
+
+// NotificationQueue stores notifications in the database and delivers them
+// in the background, retrying with exponential backoff, so that they survive
+// channel outages and restarts.
+type NotificationQueue struct {
+	repo     Repository
+	msgutils MessageUtils
+	config   ServerConfig
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewNotificationQueue(repo Repository, e MessageUtils, c ServerConfig) *NotificationQueue {
+	return &NotificationQueue{repo: repo, msgutils: e, config: c, wake: make(chan struct{}, 1),
+		stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (q *NotificationQueue) Start() {
+	go func() {
+		defer close(q.done)
+		ticker := time.NewTicker(notificationInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				q.deliverDue()
+				return
+			case <-ticker.C:
+			case <-q.wake:
+			}
+			q.deliverDue()
+		}
+	}()
+}
+
+// Stop makes a last delivery attempt and waits for the worker to exit.
+func (q *NotificationQueue) Stop() {
+	close(q.stop)
+	<-q.done
+}
+
+// Enqueue queues a plain text notification on the channels configured for
+// event.
+func (q *NotificationQueue) Enqueue(ctx context.Context, event, subject, body string) {
+	for _, channel := range q.config.GetNotifyChannels(event) {
+		q.EnqueueTo(ctx, &Notification{Event: event, Channel: channel, Subject: subject, Body: body})
+	}
+}
+
+// EnqueueTo queues n on its own channel, unless the channel is not
+// configured.
+func (q *NotificationQueue) EnqueueTo(ctx context.Context, n *Notification) {
+	logger := utils.Logger(ctx)
+	if !q.msgutils.HasChannel(n.Channel) {
+		logger.Debugf("Channel %s is not configured, not sending %s", n.Channel, n.Event)
+		return
+	}
+	if err := q.repo.EnqueueNotification(ctx, n); err != nil {
+		logger.Errorf("Cannot queue %s notification for %s: %v", n.Event, n.Channel, err)
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *NotificationQueue) deliverDue() {
+	ctx := context.Background()
+	notifications, err := q.repo.GetDueNotifications(ctx, notificationBatch)
+	if err != nil {
+		log.Warnf("Cannot read notification queue: %v", err)
+		return
+	}
+	for _, n := range notifications {
+		logger := log.WithFields(log.Fields{"notification": n.Id, "event": n.Event, "channel": n.Channel})
+		err = q.msgutils.Send(n.Channel, &utils.Message{Event: n.Event, Subject: n.Subject, Body: n.Body,
+			Format: n.Format, AttachmentName: n.AttachmentName, Attachment: n.Attachment})
+		if err == nil {
+			err = q.repo.MarkNotificationDelivered(ctx, n.Id)
+		} else {
+			giveUp := n.Attempts+1 >= notificationMaxAttempts
+			if giveUp {
+				logger.Errorf("Giving up after %d attempts: %v", n.Attempts+1, err)
+			} else {
+				logger.Warnf("Delivery failed: %v", err)
+			}
+			err = q.repo.MarkNotificationFailed(ctx, n.Id, err.Error(),
+				time.Now().Add(notificationBackoff(n.Attempts)), giveUp)
+		}
+		if err != nil {
+			logger.Warnf("Cannot update notification queue: %v", err)
+		}
+	}
+}
+
+// notificationBackoff doubles the delay after every failed attempt,
+// starting from one minute.
+func notificationBackoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return notificationMaxBackoff
+	}
+	d := time.Minute << uint(attempts)
+	if d > notificationMaxBackoff {
+		d = notificationMaxBackoff
+	}
+	return d
+}
@@ -0,0 +1,431 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+const (
+	reportDaily   = "daily"
+	reportWeekly  = "weekly"
+	reportMonthly = "monthly"
+)
+
+// limits of a single message: Slack accepts 3000 characters per section and
+// 50 blocks per message, and many webhook receivers choke on long bodies
+const (
+	maxReportText   = 3500
+	maxReportBlocks = 50
+	maxBlockText    = 3000
+	reportTopTerms  = 20
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// reportSchedule is a validated utils.ReportSchedule with its next run.
+type reportSchedule struct {
+	utils.ReportSchedule
+	location *time.Location
+	hour     int
+	minute   int
+	weekday  time.Weekday
+	next     time.Time
+}
+
+// parseReportSchedules validates the configured reports and schedules their
+// first run after now.
+func parseReportSchedules(list []utils.ReportSchedule, now time.Time) ([]*reportSchedule, error) {
+	schedules := make([]*reportSchedule, 0, len(list))
+	for i, r := range list {
+		s := &reportSchedule{ReportSchedule: r, location: time.Local}
+		s.Period = strings.ToLower(s.Period)
+		switch s.Period {
+		case reportDaily, reportWeekly, reportMonthly:
+		default:
+			return nil, fmt.Errorf("report %d: unknown period %q", i+1, r.Period)
+		}
+		at, err := time.Parse("15:04", s.At)
+		if err != nil {
+			return nil, fmt.Errorf("report %d: invalid time %q", i+1, r.At)
+		}
+		s.hour, s.minute = at.Hour(), at.Minute()
+		if s.Timezone != "" {
+			if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+				return nil, fmt.Errorf("report %d: %v", i+1, err)
+			}
+		}
+		if s.Period == reportWeekly {
+			weekday, ok := weekdays[strings.ToLower(s.Weekday)]
+			if !ok && s.Weekday != "" {
+				return nil, fmt.Errorf("report %d: unknown weekday %q", i+1, r.Weekday)
+			}
+			if !ok {
+				weekday = time.Monday
+			}
+			s.weekday = weekday
+		}
+		if s.Day == 0 {
+			s.Day = 1
+		}
+		// later days do not exist in every month
+		if s.Period == reportMonthly && (s.Day < 1 || s.Day > 28) {
+			return nil, fmt.Errorf("report %d: day must be between 1 and 28", i+1)
+		}
+		if s.Format == "" {
+			s.Format = utils.FormatText
+		}
+		if !utils.SupportsFormat(s.Channel, s.Format) {
+			return nil, fmt.Errorf("report %d: channel %q cannot send %q messages", i+1, s.Channel, s.Format)
+		}
+		if s.Name == "" {
+			s.Name = strings.Title(s.Period) + " report"
+		}
+		s.next = s.nextRun(now)
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+// nextRun returns the first time the report is due after the given one.
+func (s *reportSchedule) nextRun(after time.Time) time.Time {
+	t := after.In(s.location)
+	run := time.Date(t.Year(), t.Month(), t.Day(), s.hour, s.minute, 0, 0, s.location)
+	switch s.Period {
+	case reportMonthly:
+		run = time.Date(t.Year(), t.Month(), s.Day, s.hour, s.minute, 0, 0, s.location)
+		if !run.After(after) {
+			run = run.AddDate(0, 1, 0)
+		}
+	case reportWeekly:
+		for run.Weekday() != s.weekday || !run.After(after) {
+			run = run.AddDate(0, 0, 1)
+		}
+	default:
+		if !run.After(after) {
+			run = run.AddDate(0, 0, 1)
+		}
+	}
+	return run
+}
+
+// period returns the days covered by the report sent at run, both included:
+// the day before for daily reports, the seven days before for weekly ones
+// and the previous month for monthly ones. Days are in the schedule's time
+// zone, but returned as the stats store them.
+func (s *reportSchedule) period(run time.Time) (from, to time.Time) {
+	t := run.In(s.location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	to = day.AddDate(0, 0, -1)
+	switch s.Period {
+	case reportWeekly:
+		from = day.AddDate(0, 0, -7)
+	case reportMonthly:
+		from = time.Date(t.Year(), t.Month()-1, 1, 0, 0, 0, 0, time.Local)
+		to = from.AddDate(0, 1, -1)
+	default:
+		from = to
+	}
+	return
+}
+
+// Report summarizes the stats of a period.
+type Report struct {
+	Title    string
+	Users    int
+	Hits     int
+	Searches int
+	NotFound int
+	BotHits  int
+	Found    []*SearchStat
+	Missing  []*SearchStat
+	All      []*SearchStat
+	// visits are only reported if visitor history is kept
+	Visits []*VisitStat
+}
+
+// Truncated tells if the report leaves out some of the searches or the
+// visits, which then go to an attachment when the channel allows it.
+func (r *Report) Truncated() bool {
+	return len(r.Found)+len(r.Missing) < len(r.All) || len(r.Visits) > 0
+}
+
+func (stats *StatsTracker) collectReport(ctx context.Context, title string, from, to time.Time) (*Report, error) {
+	searches, err := stats.repo.GetSearchStats(ctx, from, to, 0)
+	if err != nil {
+		return nil, err
+	}
+	visits, err := stats.repo.GetVisitStats(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	bots, err := stats.repo.GetCounterTotals(ctx, counterBot, from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Title: title, All: searches}
+	visitors := make(map[string]bool)
+	for _, v := range visits {
+		report.Hits += v.Hits
+		visitors[v.Visitor] = true
+	}
+	report.Users = len(visitors)
+	for _, s := range searches {
+		report.Searches += s.Hits
+		if !s.Found {
+			report.NotFound += s.Hits
+			if len(report.Missing) < reportTopTerms {
+				report.Missing = append(report.Missing, s)
+			}
+		} else if len(report.Found) < reportTopTerms {
+			report.Found = append(report.Found, s)
+		}
+	}
+	for _, n := range bots {
+		report.BotHits += n
+	}
+	if stats.config.GetPrivacyVisitorHistory() {
+		report.Visits = visits
+	}
+	return report, nil
+}
+
+// runReports sends the reports that are due.
+func (stats *StatsTracker) runReports(now time.Time) {
+	stats.reportMutex.Lock()
+	defer stats.reportMutex.Unlock()
+	for _, s := range stats.reports {
+		if now.Before(s.next) {
+			continue
+		}
+		from, to := s.period(s.next)
+		s.next = s.nextRun(now)
+		stats.sendReport(s, from, to)
+	}
+}
+
+func (stats *StatsTracker) sendReport(s *reportSchedule, from, to time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), statsFlushTimeout)
+	defer cancel()
+	title := s.Name + " " + from.Format("2006-01-02")
+	if !to.Equal(from) {
+		title += " to " + to.Format("2006-01-02")
+	}
+	report, err := stats.collectReport(ctx, title, from, to)
+	if err != nil {
+		log.Warnf("Cannot read stats for %s: %v", title, err)
+		return
+	}
+	for _, n := range renderReport(report, s.Period+"-report", s.Channel, s.Format) {
+		stats.notifier.EnqueueTo(ctx, n)
+	}
+}
+
+// renderReport formats the report for the channel. Email gets a summary
+// with the details in a CSV attachment, Slack and webhooks get as many
+// messages as needed to stay within their limits.
+func renderReport(r *Report, event, channel, format string) []*Notification {
+	var bodies []string
+	switch {
+	case channel == "email":
+		n := &Notification{Event: event, Channel: channel, Subject: r.Title, Format: format}
+		if format == utils.FormatHTML {
+			n.Body = reportHTML(r)
+		} else {
+			n.Body = reportSummary(r)
+		}
+		if r.Truncated() {
+			n.AttachmentName = strings.Replace(strings.ToLower(r.Title), " ", "-", -1) + ".csv"
+			n.Attachment = reportCSV(r)
+		}
+		return []*Notification{n}
+	case format == utils.FormatSlack:
+		bodies = reportBlocks(r)
+	default:
+		bodies = splitText(reportText(r), maxReportText)
+	}
+	notifications := make([]*Notification, len(bodies))
+	for i, body := range bodies {
+		subject := r.Title
+		if len(bodies) > 1 {
+			subject += fmt.Sprintf(" (%d/%d)", i+1, len(bodies))
+		}
+		notifications[i] = &Notification{Event: event, Channel: channel, Subject: subject,
+			Body: body, Format: format}
+	}
+	return notifications
+}
+
+func formatTerms(terms []*SearchStat) []string {
+	lines := make([]string, len(terms))
+	for i, s := range terms {
+		lines[i] = s.Term + " (" + s.LangPair + ") " + strconv.Itoa(s.Hits)
+	}
+	return lines
+}
+
+func formatVisit(v *VisitStat) string {
+	return v.Ip + " (" + v.City + ", " + v.Country + "). Agent: " + v.UserAgent + ". Referer: " + v.Referer +
+		". Hits: " + strconv.Itoa(v.Hits) + ". Last Uri: " + v.LastUri + "."
+}
+
+func reportSummary(r *Report) string {
+	var buffer bytes.Buffer
+	buffer.WriteString("Users: " + strconv.Itoa(r.Users) + ". Hits: " + strconv.Itoa(r.Hits) + ". ")
+	buffer.WriteString("Searches: " + strconv.Itoa(r.Searches) + ", not found: " + strconv.Itoa(r.NotFound) + ". ")
+	buffer.WriteString("Bot hits: " + strconv.Itoa(r.BotHits) + ".")
+	if len(r.Found) > 0 {
+		buffer.WriteString("\n\nTop searches: " + strings.Join(formatTerms(r.Found), ", ") + ".")
+	}
+	if len(r.Missing) > 0 {
+		buffer.WriteString("\n\nNot found: " + strings.Join(formatTerms(r.Missing), ", ") + ".")
+	}
+	return buffer.String()
+}
+
+func reportText(r *Report) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(reportSummary(r))
+	for _, v := range r.Visits {
+		buffer.WriteString("\n\n" + formatVisit(v))
+	}
+	return buffer.String()
+}
+
+// splitText cuts text into parts of at most max bytes, between paragraphs
+// when possible.
+func splitText(text string, max int) []string {
+	parts := make([]string, 0, 1)
+	var current string
+	for _, p := range strings.Split(text, "\n\n") {
+		for len(p) > max {
+			cut := max
+			for !utf8.RuneStart(p[cut]) {
+				cut--
+			}
+			if current != "" {
+				parts = append(parts, current)
+				current = ""
+			}
+			parts = append(parts, p[:cut])
+			p = p[cut:]
+		}
+		switch {
+		case current == "":
+			current = p
+		case len(current)+2+len(p) <= max:
+			current += "\n\n" + p
+		default:
+			parts = append(parts, current)
+			current = p
+		}
+	}
+	return append(parts, current)
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func slackSection(text string) slackBlock {
+	if len(text) > maxBlockText {
+		text = splitText(text, maxBlockText-3)[0] + "..."
+	}
+	return slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}}
+}
+
+// reportBlocks returns the report as Slack blocks, as many JSON arrays as
+// needed to stay within the blocks allowed in a message.
+func reportBlocks(r *Report) []string {
+	blocks := []slackBlock{
+		{Type: "header", Text: &slackText{Type: "plain_text", Text: r.Title}},
+		slackSection(fmt.Sprintf("*Users:* %d   *Hits:* %d   *Searches:* %d   *Not found:* %d   *Bot hits:* %d",
+			r.Users, r.Hits, r.Searches, r.NotFound, r.BotHits)),
+	}
+	for _, list := range []struct {
+		title string
+		terms []*SearchStat
+	}{{"Top searches", r.Found}, {"Not found", r.Missing}} {
+		if len(list.terms) > 0 {
+			blocks = append(blocks, slackSection("*"+list.title+"*\n• "+
+				slackEscaper.Replace(strings.Join(formatTerms(list.terms), "\n• "))))
+		}
+	}
+	for _, v := range r.Visits {
+		blocks = append(blocks, slackSection(slackEscaper.Replace(formatVisit(v))))
+	}
+	bodies := make([]string, 0, 1)
+	for i := 0; i < len(blocks); i += maxReportBlocks {
+		end := i + maxReportBlocks
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		body, _ := json.Marshal(blocks[i:end])
+		bodies = append(bodies, string(body))
+	}
+	return bodies
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<html><body>
+<h2>{{.Title}}</h2>
+<p>Users: {{.Users}}. Hits: {{.Hits}}. Searches: {{.Searches}}, not found: {{.NotFound}}. Bot hits: {{.BotHits}}.</p>
+{{define "terms"}}<table border="1" cellpadding="3" style="border-collapse:collapse">
+<tr><th>Term</th><th>Languages</th><th>Searches</th></tr>
+{{range .}}<tr><td>{{.Term}}</td><td>{{.LangPair}}</td><td align="right">{{.Hits}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Found}}<h3>Top searches</h3>{{template "terms" .Found}}{{end}}
+{{if .Missing}}<h3>Not found</h3>{{template "terms" .Missing}}{{end}}
+{{if .Truncated}}<p>The full details are attached.</p>{{end}}
+</body></html>`))
+
+func reportHTML(r *Report) string {
+	var buffer bytes.Buffer
+	if err := reportTemplate.Execute(&buffer, r); err != nil {
+		log.Warnf("Cannot render report: %v", err)
+	}
+	return buffer.String()
+}
+
+// reportCSV returns every search of the report and, if kept, the visits,
+// as two tables separated by an empty line.
+func reportCSV(r *Report) string {
+	var buffer bytes.Buffer
+	w := csv.NewWriter(&buffer)
+	w.Write([]string{"languages", "term", "found", "searches"})
+	for _, s := range r.All {
+		w.Write([]string{s.LangPair, s.Term, strconv.FormatBool(s.Found), strconv.Itoa(s.Hits)})
+	}
+	if len(r.Visits) > 0 {
+		w.Flush()
+		buffer.WriteString("\n")
+		w.Write([]string{"day", "ip", "city", "region", "country", "user_agent", "referer", "last_uri", "hits"})
+		for _, v := range r.Visits {
+			w.Write([]string{v.Day.Format("2006-01-02"), v.Ip, v.City, v.Region, v.Country, v.UserAgent,
+				v.Referer, v.LastUri, strconv.Itoa(v.Hits)})
+		}
+	}
+	w.Flush()
+	return buffer.String()
+}
@@ -1,110 +1,262 @@
 package web
 
 import (
-	"bytes"
-	"encoding/json"
-	"net/http"
-	"strconv"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
+	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
 	"github.com/roylee0704/gron"
 	"github.com/roylee0704/gron/xtime"
 )
 
+const (
+	statsFlushTimeout = 30 * time.Second
+	// stats that cannot be saved are dropped after this many flushes
+	statsMaxRetries = 5
+	// the length of the key columns of the stats
+	statsKeyLength = 255
+)
+
 type User struct {
-	Ip            string
-	City          string
-	Region        string
-	Country       string
-	SearchedWords map[string]bool
-	Counter       int64
-	Referer       string
-	UserAgent     string
-	LastUri       string
+	Ip        string
+	City      string
+	Region    string
+	Country   string
+	Counter   int64
+	Referer   string
+	UserAgent string
+	LastUri   string
+	Day       time.Time `json:"-"`
+	Visitor   string    `json:"-"`
+}
+
+type counterKey struct {
+	day  time.Time
+	name string
+	key  string
 }
 
+type searchKey struct {
+	day      time.Time
+	langPair string
+	term     string
+	found    bool
+}
+
+// StatsTracker counts visits and searches in memory and adds them to the
+// aggregates stored in the database every minute. The daily report is
+// built from the stored aggregates, on the configured schedules.
 type StatsTracker struct {
 	mutex     sync.Mutex
 	keyToUser map[string]*User
-	msgutils  MessageUtils
+	searches  map[searchKey]int
+	counters  map[counterKey]int
+	repo      Repository
+	notifier  *NotificationQueue
+	geo       Geolocator
+	ips       *utils.IPAnonymizer
+	config    ServerConfig
+	cron      *gron.Cron
+	// failures counts the flushes failed in a row
+	failures int
+	// reportMutex keeps a slow run of the reports from overlapping the next
+	reportMutex sync.Mutex
+	reports     []*reportSchedule
 }
 
-func NewStatsTracker(e MessageUtils) *StatsTracker {
-	stats := &StatsTracker{msgutils: e}
+func NewStatsTracker(repo Repository, n *NotificationQueue, g Geolocator, a *utils.IPAnonymizer, c ServerConfig) (*StatsTracker, error) {
+	list, err := c.GetReports()
+	if err != nil {
+		return nil, err
+	}
+	reports, err := parseReportSchedules(list, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	stats := &StatsTracker{repo: repo, notifier: n, geo: g, ips: a, config: c, reports: reports}
 	stats.keyToUser = make(map[string]*User)
+	stats.searches = make(map[searchKey]int)
+	stats.counters = make(map[counterKey]int)
 
-	c := gron.New()
-	c.AddFunc(gron.Every(1*xtime.Day).At("16:00"), func() {
-		stats.sendSummaryAndClear()
+	stats.cron = gron.New()
+	// reports are due on the minute, in their own time zone
+	stats.cron.AddFunc(gron.Every(time.Minute), func() {
+		stats.flush()
+		stats.runReports(time.Now())
 	})
-	c.Start()
+	stats.cron.AddFunc(gron.Every(1*xtime.Day).At("03:00"), func() {
+		stats.purge()
+	})
+	stats.cron.Start()
+
+	return stats, nil
+}
 
-	return stats
+// Stop cancels the scheduled jobs and stores what has been collected so far.
+func (stats *StatsTracker) Stop() {
+	stats.cron.Stop()
+	stats.flush()
 }
 
-func (stats *StatsTracker) sendSummaryAndClear() {
+func today() time.Time {
+	y, m, d := time.Now().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// flush saves the counters to the database and resets them. If saving
+// fails, they are kept for the next flush, unless it already failed
+// statsMaxRetries times in a row: the stats are then dropped, as they may be
+// what the database rejects.
+func (stats *StatsTracker) flush() {
+	stats.mutex.Lock()
+	users, searches, counters := stats.keyToUser, stats.searches, stats.counters
+	stats.keyToUser = make(map[string]*User)
+	stats.searches = make(map[searchKey]int)
+	stats.counters = make(map[counterKey]int)
+	stats.mutex.Unlock()
+	if len(users) == 0 && len(searches) == 0 && len(counters) == 0 {
+		return
+	}
+
+	searchStats := make([]*SearchStat, 0, len(searches))
+	for k, hits := range searches {
+		searchStats = append(searchStats, &SearchStat{Day: k.day, LangPair: k.langPair, Term: k.term,
+			Found: k.found, Hits: hits})
+	}
+	visitStats := make([]*VisitStat, 0, len(users))
+	for _, user := range users {
+		visitStats = append(visitStats, &VisitStat{Day: user.Day, Visitor: user.Visitor, Ip: user.Ip,
+			City: user.City, Region: user.Region, Country: user.Country, UserAgent: user.UserAgent,
+			Referer: user.Referer, LastUri: user.LastUri, Hits: int(user.Counter)})
+	}
+	counterStats := make([]*CounterStat, 0, len(counters))
+	for k, hits := range counters {
+		counterStats = append(counterStats, &CounterStat{Day: k.day, Name: k.name, Key: k.key, Hits: hits})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statsFlushTimeout)
+	defer cancel()
+	err := stats.repo.SaveStats(ctx, searchStats, visitStats, counterStats)
 	stats.mutex.Lock()
 	defer stats.mutex.Unlock()
-	var buffer bytes.Buffer
-	buffer.WriteString("Users: " + strconv.Itoa(len(stats.keyToUser)) + ".")
-	for _, user := range stats.keyToUser {
-		buffer.WriteString("\n\n")
-		buffer.WriteString(user.Ip + " (" + user.City + ", " + user.Country + "). ")
-		buffer.WriteString("Agent: " + user.UserAgent + ". ")
-		buffer.WriteString("Referer: " + user.Referer + ". ")
-		buffer.WriteString("Hits: " + strconv.FormatInt(user.Counter, 10) + ". ")
-		buffer.WriteString("Last Uri: " + user.LastUri + ". ")
-		if len(user.SearchedWords) > 0 {
-			buffer.WriteString("Words:")
-			i := 0
-			for word, _ := range user.SearchedWords {
-				buffer.WriteString(" " + word)
-				if i < len(user.SearchedWords)-1 {
-					buffer.WriteString(",")
-				}
-			}
-			buffer.WriteString(".")
+	if err == nil {
+		stats.failures = 0
+		return
+	}
+	if stats.failures++; stats.failures > statsMaxRetries {
+		log.Errorf("Cannot save stats, dropping them after %d attempts: %v", stats.failures, err)
+		stats.failures = 0
+		return
+	}
+	log.Warnf("Cannot save stats, keeping them for later: %v", err)
+	stats.restore(users, searches, counters)
+}
+
+// restore adds back the stats that could not be saved. The mutex must be held.
+func (stats *StatsTracker) restore(users map[string]*User, searches map[searchKey]int, counters map[counterKey]int) {
+	for k, hits := range searches {
+		stats.searches[k] += hits
+	}
+	for k, hits := range counters {
+		stats.counters[k] += hits
+	}
+	for key, user := range users {
+		if current := stats.keyToUser[key]; current != nil {
+			current.Counter += user.Counter
+		} else {
+			stats.keyToUser[key] = user
 		}
 	}
-	stats.msgutils.SendToSlack("Daily Report: " + buffer.String())
-	stats.keyToUser = make(map[string]*User)
 }
 
+// purge deletes the stats older than the retention period. Without one,
+// only the rate events are purged.
+func (stats *StatsTracker) purge() {
+	var before time.Time
+	if days := stats.config.GetStatsRetentionDays(); days > 0 {
+		before = today().AddDate(0, 0, -days)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statsFlushTimeout)
+	defer cancel()
+	if err := stats.repo.PurgeStats(ctx, before); err != nil {
+		log.Warnf("Cannot purge stats: %v", err)
+	}
+}
+
+func visitorHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// getOrAddUser returns the visitor identified by key today, adding usr if
+// it is their first request of the day.
 func (stats *StatsTracker) getOrAddUser(usr *User, key string) *User {
-	user := stats.keyToUser[key]
+	day := today()
+	user := stats.keyToUser[day.Format("2006-01-02")+key]
 	if user == nil {
 		user = usr
-		user.SearchedWords = make(map[string]bool)
-		stats.keyToUser[key] = user
+		user.Day = day
+		user.Visitor = visitorHash(key)
+		stats.keyToUser[day.Format("2006-01-02")+key] = user
 	}
 	user.Counter++
 	user.LastUri = usr.LastUri
-	if user.City == "" {
-		user.getLocation()
-	}
 	return user
 }
 
-func (stats *StatsTracker) NotifyUser(usr *User, key string, word string) {
+// NotifyUser counts a request of a visitor, identified by their address and
+// user agent. The address is located, then anonymized, before being stored.
+// The headers are cleaned, as clients can send anything in them.
+func (stats *StatsTracker) NotifyUser(usr *User) {
+	usr.UserAgent, usr.Referer, usr.LastUri = cleanText(usr.UserAgent), cleanText(usr.Referer), cleanText(usr.LastUri)
+	// the geolocator caches addresses, but keep it out of the lock anyway
+	location := stats.geo.Locate(usr.Ip)
+	usr.Ip = stats.ips.Anonymize(usr.Ip)
+	if !stats.config.GetPrivacyVisitorHistory() {
+		usr.LastUri, usr.Referer = "", ""
+	}
+	key := usr.Ip + usr.UserAgent
 	stats.mutex.Lock()
 	defer stats.mutex.Unlock()
 	user := stats.getOrAddUser(usr, key)
-	if word != "" {
-		user.SearchedWords[word] = true
+	if user.Country == "" && location != nil {
+		user.City, user.Region, user.Country = location.City, location.Region, location.Country
 	}
 }
 
-func (user *User) getLocation() error {
-	r, err := http.Get("http://ipinfo.io/" + user.Ip + "/json")
-	if err != nil {
-		return err
-	}
-	defer r.Body.Close()
+// NotifySearch counts a search of term in the dictionary langPair, e.g. "itaeng".
+func (stats *StatsTracker) NotifySearch(langPair, term string, found bool) {
+	term = truncate(cleanText(term), statsKeyLength)
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.searches[searchKey{day: today(), langPair: langPair, term: term, found: found}]++
+}
 
-	err = json.NewDecoder(r.Body).Decode(user)
-	if err != nil {
-		return err
-	}
+// NotifyCounter counts an occurrence of key in the counter name. Keys longer
+// than the database allows, like the host of a forged referer, are cut.
+func (stats *StatsTracker) NotifyCounter(name, key string) {
+	key = truncate(cleanText(key), statsKeyLength)
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.counters[counterKey{day: today(), name: name, key: key}]++
+}
 
-	return nil
+// cleanText drops the invalid UTF-8 sequences and the NUL characters of s,
+// which the database rejects.
+func cleanText(s string) string {
+	return strings.Replace(strings.ToValidUTF8(s, ""), "\x00", "", -1)
+}
+
+// truncate cuts s to at most max characters.
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
 }
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/excel"
+	"github.com/beppeben/go-dictionary/utils"
+)
+
+type SuggestionsContent struct {
+	Status      string
+	Statuses    []string
+	Suggestions []*Suggestion
+}
+
+var suggestionStatuses = []string{SuggestionPending, SuggestionAdded, SuggestionRejected}
+
+// SuggestionsHTML lists the suggestions with the status query parameter,
+// pending ones by default.
+func (handler WebserviceHandler) SuggestionsHTML(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = SuggestionPending
+	} else if status == "all" {
+		status = ""
+	}
+	suggestions, err := handler.repo.GetSuggestions(r.Context(), status)
+	if err != nil {
+		panic(err)
+	}
+	content := &SuggestionsContent{Status: status, Statuses: suggestionStatuses, Suggestions: suggestions}
+	t := template.Must(template.New("suggestions.html").ParseFiles(handler.config.GetHTTPDir() + "suggestions.html"))
+	t.Execute(w, content)
+}
+
+func (handler WebserviceHandler) SetSuggestionStatus(w http.ResponseWriter, r *http.Request) {
+	logger := utils.Logger(r.Context())
+	id, err := strconv.ParseInt(getParams(r).ByName("id"), 10, 64)
+	if err != nil {
+		auditError(r, err)
+		fmt.Fprintf(w, "Error moderating suggestion: invalid id %s", getParams(r).ByName("id"))
+		return
+	}
+	status := r.FormValue("status")
+	if err = handler.repo.SetSuggestionStatus(r.Context(), id, status); err != nil {
+		logger.Warnf("%s", err)
+		auditError(r, err)
+		fmt.Fprintf(w, "Error moderating suggestion: %v", err)
+		return
+	}
+	logger.Infof("Suggestion %d marked as %s", id, status)
+	if r.FormValue("redirect") != "" {
+		http.Redirect(w, r, "/admin/suggestions", http.StatusSeeOther)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// SuggestionsXLSX exports the pending suggestions as a workbook with one
+// sheet per language, having the columns of the dictionary table so that the
+// rows can be completed and pasted in the main workbook, plus a summary sheet.
+func (handler WebserviceHandler) SuggestionsXLSX(w http.ResponseWriter, r *http.Request) {
+	suggestions, err := handler.repo.GetSuggestions(r.Context(), SuggestionPending)
+	if err != nil {
+		panic(err)
+	}
+	summary := [][]string{{"word", "from", "to", "count", "first_seen", "last_seen"}}
+	sheets := make(map[string][][]string)
+	langs := make([]string, 0)
+	for _, s := range suggestions {
+		summary = append(summary, []string{s.Word, s.FromLang, s.ToLang, strconv.Itoa(s.Count),
+			s.FirstSeen.Format("2006-01-02"), s.LastSeen.Format("2006-01-02")})
+		matrix, ok := sheets[s.FromLang]
+		if !ok {
+			columns, err := handler.repo.GetTableColumns(r.Context(), s.FromLang)
+			if err != nil {
+				panic(err)
+			}
+			matrix = [][]string{columns}
+			langs = append(langs, s.FromLang)
+		}
+		row := make([]string, len(matrix[0]))
+		for i, column := range matrix[0] {
+			if column == "word" {
+				row[i] = s.Word
+			}
+		}
+		sheets[s.FromLang] = append(matrix, row)
+	}
+
+	writer := excel.NewWriter()
+	if err = writer.AddMatrix("suggestions", summary); err != nil {
+		panic(err)
+	}
+	for _, lang := range langs {
+		if err = writer.AddMatrix(lang, sheets[lang]); err != nil {
+			panic(err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", "attachment; filename=suggestions-"+time.Now().Format("2006-01-02")+".xlsx")
+	if err = writer.Write(w); err != nil {
+		utils.Logger(r.Context()).Warnf("Writing suggestions: %v", err)
+	}
+}
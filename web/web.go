@@ -1,32 +1,86 @@
 package web
 
 import (
+	"context"
+	"database/sql"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	. "github.com/beppeben/go-dictionary/domain"
-	"github.com/gorilla/context"
+	"github.com/beppeben/go-dictionary/utils"
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
 )
 
 type Repository interface {
-	ResetDB() error
-	ResetCalendar() error
-	GetCalendarEvents(month int, year int) (events []*CalendarEvent, err error)
-	GetLangFromKey(key string) string
-	Search(word, fromLang, toLang, baseLang string) (words []*Word, err error)
-	GetWordsWithTerm(term string, lang1 string, lang2 string) (words []*SimpleWord, err error)
-	GetLanguages(base string) []*Language
-	GetWebTerm(lang, key string) string
+	ResetDB(ctx context.Context) (map[string]int, error)
+	ResetCalendar(ctx context.Context) (map[string]int, error)
+	GetCalendarEvents(ctx context.Context, month int, year int, lang string) ([]*CalendarEvent, error)
+	GetCalendarFeed(ctx context.Context, tag string, since time.Time, lang string) ([]*CalendarEvent, error)
+	GetCalendarRange(ctx context.Context, filter *CalendarFilter, lang string) ([]*CalendarEvent, error)
+	ImportCalendarEvents(ctx context.Context, events []*CalendarEvent, replace bool) (map[string]int, error)
+	GetLangFromKey(ctx context.Context, key string) string
+	Search(ctx context.Context, word, fromLang, toLang, baseLang string) (words []*Word, err error)
+	GetWordsWithTerm(ctx context.Context, term string, lang1 string, lang2 string) (words []*SimpleWord, err error)
+	GetLanguages(ctx context.Context, base string) []*Language
+	GetWebTerm(ctx context.Context, lang, key string) string
+	Ping(ctx context.Context) error
+	GetStatus(ctx context.Context) *DictionaryStatus
+	GetDBStats(ctx context.Context) sql.DBStats
+	GetCachedWordsCount(ctx context.Context) int
+	GetUser(ctx context.Context, username string) (*AdminUser, error)
+	CountUsers(ctx context.Context) (int, error)
+	CreateToken(ctx context.Context, token *ApiToken, hash string) error
+	GetTokenByHash(ctx context.Context, hash string) (*ApiToken, error)
+	ListTokens(ctx context.Context) ([]*ApiToken, error)
+	RevokeToken(ctx context.Context, id int64) error
+	AddAuditRecord(ctx context.Context, record *AuditRecord) error
+	GetAuditRecords(ctx context.Context, filter *AuditFilter) ([]*AuditRecord, error)
+	AddSuggestion(ctx context.Context, word, fromLang, toLang, ip string, perHour int) (*Suggestion, error)
+	GetSuggestions(ctx context.Context, status string) ([]*Suggestion, error)
+	SetSuggestionStatus(ctx context.Context, id int64, status string) error
+	GetTableColumns(ctx context.Context, title string) ([]string, error)
+	AddFeedback(ctx context.Context, f *Feedback, perHour int) error
+	GetOpenFeedback(ctx context.Context, lang string, conceptId int64) ([]*Feedback, error)
+	ResolveFeedback(ctx context.Context, id int64) error
+	EnqueueNotification(ctx context.Context, n *Notification) error
+	GetDueNotifications(ctx context.Context, limit int) ([]*Notification, error)
+	MarkNotificationDelivered(ctx context.Context, id int64) error
+	MarkNotificationFailed(ctx context.Context, id int64, lastError string, next time.Time, giveUp bool) error
+	SaveStats(ctx context.Context, searches []*SearchStat, visits []*VisitStat, counters []*CounterStat) error
+	GetSearchStats(ctx context.Context, from, to time.Time, limit int) ([]*SearchStat, error)
+	GetVisitStats(ctx context.Context, from, to time.Time) ([]*VisitStat, error)
+	GetTopSearches(ctx context.Context, from, to time.Time, found bool, perPair int) ([]*SearchStat, error)
+	GetSearchTotals(ctx context.Context, from, to time.Time) (map[string]int, error)
+	GetCounterTotals(ctx context.Context, name string, from, to time.Time) (map[string]int, error)
+	PurgeStats(ctx context.Context, before time.Time) error
+	UpdateWebTerm(ctx context.Context, lang, key, value string) error
+	UpdateEntry(ctx context.Context, lang string, enId int64, word, field, value string) error
 }
 
 type ServerConfig interface {
 	GetHTTPDir() string
 	GetAdminPass() string
 	GetServerPort() string
+	GetSearchTimeout() time.Duration
+	GetAutocompleteTimeout() time.Duration
+	GetCalendarTimeout() time.Duration
+	GetImportTimeout() time.Duration
+	GetFeedbackPerHour() int
+	GetSuggestionsPerHour() int
+	GetNotifyChannels(event string) []string
+	GetGeoIPDB() string
+	GetPrivacyIPMode() string
+	GetPrivacyVisitorHistory() bool
+	GetPrivacyHonourDNT() bool
+	GetStatsRetentionDays() int
+	GetBotUserAgents() []string
+	GetBotMaxPerMinute() int
+	GetReports() ([]utils.ReportSchedule, error)
 }
 
 type SysUtils interface {
@@ -35,9 +89,12 @@ type SysUtils interface {
 }
 
 type MessageUtils interface {
-	//SendEmail(email, title, text string) error
-	//SendEmailToAdmins(subject, body string) error
-	SendToSlack(text string) error
+	HasChannel(channel string) bool
+	Send(channel string, m *utils.Message) error
+}
+
+type Geolocator interface {
+	Locate(ip string) *utils.Location
 }
 
 type WebserviceHandler struct {
@@ -48,70 +105,151 @@ type WebserviceHandler struct {
 	sutils   SysUtils
 	msgutils MessageUtils
 	stats    *StatsTracker
+	ips      *utils.IPAnonymizer
+	bots     *BotClassifier
+	notifier *NotificationQueue
+	metrics  *Metrics
+	server   *http.Server
 }
 
 type router struct {
 	*httprouter.Router
+	metrics *Metrics
 }
 
-func NewWebHandler(repo Repository, c ServerConfig, s SysUtils, e MessageUtils) *WebserviceHandler {
-	tracker := NewStatsTracker(e)
-	return &WebserviceHandler{repo: repo, config: c, sutils: s, msgutils: e, stats: tracker}
+func NewWebHandler(repo Repository, c ServerConfig, s SysUtils, e MessageUtils, g Geolocator) (*WebserviceHandler, error) {
+	ips, err := utils.NewIPAnonymizer(c.GetPrivacyIPMode())
+	if err != nil {
+		return nil, err
+	}
+	notifier := NewNotificationQueue(repo, e, c)
+	tracker, err := NewStatsTracker(repo, notifier, g, ips, c)
+	if err != nil {
+		return nil, err
+	}
+	return &WebserviceHandler{repo: repo, config: c, sutils: s, msgutils: e, stats: tracker, ips: ips,
+		bots: NewBotClassifier(c.GetBotUserAgents(), c.GetBotMaxPerMinute()), notifier: notifier, metrics: NewMetrics(repo), server: &http.Server{Addr: ":" + c.GetServerPort()}}, nil
 }
 
-func (h WebserviceHandler) StartServer() {
-	commonHandlers := alice.New(context.ClearHandler, h.LoggingHandler, h.StatsHandler, h.RecoverHandler)
-	commonHandlersNoStats := alice.New(context.ClearHandler, h.LoggingHandler, h.RecoverHandler)
-	h.mrouter = NewRouter()
+// StartServer binds the server port and serves requests in the background.
+// An error is returned if the port cannot be bound.
+func (h WebserviceHandler) StartServer() error {
+	commonHandlers := alice.New(h.RequestIDHandler, h.LoggingHandler, h.StatsHandler, h.RecoverHandler)
+	commonHandlersNoStats := alice.New(h.RequestIDHandler, h.LoggingHandler, h.RecoverHandler)
+	// probes are polled by the load balancer, keep them out of the logs
+	probeHandlers := alice.New(h.RequestIDHandler, h.RecoverHandler)
+	h.mrouter = NewRouter(h.metrics)
 	h.frouter = http.NewServeMux()
 	h.frouter.Handle("/", http.FileServer(http.Dir(h.config.GetHTTPDir())))
 
 	h.mrouter.Get("/services/autocomplete/:langkey", commonHandlersNoStats.ThenFunc(h.Autocomplete))
-	h.mrouter.Post("/services/deployFront", commonHandlersNoStats.Append(h.BasicAuth).ThenFunc(h.DeployFront))
-	h.mrouter.Post("/services/deployDb", commonHandlersNoStats.Append(h.BasicAuth).ThenFunc(h.DeployDb))
-	h.mrouter.Post("/services/deployCal", commonHandlersNoStats.Append(h.BasicAuth).ThenFunc(h.DeployCal))
-	h.mrouter.Get("/services/notify", commonHandlersNoStats.ThenFunc(h.Notify))
+	// administrative changes are audited, including rejected attempts with credentials
+	admin := func(action string, perm Permission) alice.Chain {
+		return commonHandlersNoStats.Append(h.Audit(action), h.Authorize(perm))
+	}
+	h.mrouter.Post("/services/deployFront", admin("deploy-front", PermDeployFront).ThenFunc(h.DeployFront))
+	h.mrouter.Post("/services/deployDb", admin("deploy-db", PermDeployDb).ThenFunc(h.DeployDb))
+	h.mrouter.Post("/services/deployCal", admin("deploy-cal", PermDeployCal).ThenFunc(h.DeployCal))
+	h.mrouter.Post("/services/webString", admin("edit-web", PermEditWeb).ThenFunc(h.UpdateWebString))
+	h.mrouter.Post("/services/entry", admin("edit-entry", PermEditEntries).ThenFunc(h.UpdateEntry))
+	h.mrouter.Get("/services/tokens", commonHandlersNoStats.Append(h.Authorize(PermManageTokens)).ThenFunc(h.ListTokens))
+	h.mrouter.Post("/services/tokens", admin("create-token", PermManageTokens).ThenFunc(h.CreateToken))
+	h.mrouter.Post("/services/tokens/:id/revoke", admin("revoke-token", PermManageTokens).ThenFunc(h.RevokeToken))
+	h.mrouter.Post("/services/suggestions/:id/status", admin("moderate-suggestion", PermEditEntries).ThenFunc(h.SetSuggestionStatus))
+	h.mrouter.Get("/admin/suggestions", commonHandlersNoStats.Append(h.Authorize(PermEditEntries)).ThenFunc(h.SuggestionsHTML))
+	h.mrouter.Get("/admin/suggestions.xlsx", commonHandlersNoStats.Append(h.Authorize(PermEditEntries)).ThenFunc(h.SuggestionsXLSX))
+	h.mrouter.Get("/admin/feedback", commonHandlersNoStats.Append(h.Authorize(PermEditEntries)).ThenFunc(h.FeedbackHTML))
+	statsHandlers := commonHandlersNoStats.Append(h.Authorize(PermReadStats))
+	h.mrouter.Get("/admin/stats", statsHandlers.ThenFunc(h.StatsHTML))
+	h.mrouter.Get("/admin/stats/searches", statsHandlers.ThenFunc(h.TopSearchesJSON))
+	h.mrouter.Get("/admin/stats/conversion", statsHandlers.ThenFunc(h.ConversionJSON))
+	h.mrouter.Get("/admin/stats/languages", statsHandlers.ThenFunc(h.counterJSON(counterBaseLang)))
+	h.mrouter.Get("/admin/stats/referers", statsHandlers.ThenFunc(h.counterJSON(counterReferer)))
+	h.mrouter.Get("/admin/stats/bots", statsHandlers.ThenFunc(h.counterJSON(counterBot)))
+	h.mrouter.Get("/admin/audit", commonHandlersNoStats.Append(h.Authorize(PermReadAudit)).ThenFunc(h.AuditHTML))
+	h.mrouter.Get("/admin/audit.csv", commonHandlersNoStats.Append(h.Authorize(PermReadAudit)).ThenFunc(h.AuditCSV))
+	h.mrouter.Post("/services/notify", commonHandlersNoStats.ThenFunc(h.Notify))
+	h.mrouter.Post("/services/feedback", commonHandlersNoStats.ThenFunc(h.SendFeedback))
+	h.mrouter.Get("/services/feedback", commonHandlersNoStats.Append(h.Authorize(PermEditEntries)).ThenFunc(h.FeedbackJSON))
+	h.mrouter.Post("/services/feedback/:id/resolve", admin("resolve-feedback", PermEditEntries).ThenFunc(h.ResolveFeedback))
 	h.mrouter.Get("/search/:langkey/:term", commonHandlers.ThenFunc(h.IndexHTML))
 	h.mrouter.Get("/calendar", commonHandlers.ThenFunc(h.CalendarHTMLDefault))
+	h.mrouter.Get("/calendar.ics", commonHandlers.ThenFunc(h.CalendarICS))
+	h.mrouter.Get("/calendar/:year", commonHandlers.ThenFunc(h.CalendarYearHTML))
 	h.mrouter.Get("/calendar/:year/:month", commonHandlers.ThenFunc(h.CalendarHTML))
+	h.mrouter.Get("/api/v1/events", commonHandlers.ThenFunc(h.EventsJSON))
 	h.mrouter.Get("/index.html", commonHandlers.ThenFunc(h.IndexHTML))
 	h.mrouter.Get("/terms.html", commonHandlers.ThenFunc(h.TermsHTML))
 	h.mrouter.Get("/about.html", commonHandlers.ThenFunc(h.AboutHTML))
+	h.mrouter.Get("/robots.txt", commonHandlers.ThenFunc(h.RobotsTxt))
 	h.mrouter.Get("/", commonHandlers.ThenFunc(h.IndexHTML))
-
-	var err error
+	h.mrouter.Get("/healthz", probeHandlers.ThenFunc(h.Healthz))
+	h.mrouter.Get("/readyz", probeHandlers.ThenFunc(h.Readyz))
+	h.mrouter.Get("/version", commonHandlersNoStats.ThenFunc(h.Version))
+	h.mrouter.Get("/metrics", probeHandlers.Then(h.metrics.Handler()))
 
 	r := http.NewServeMux()
 	r.HandleFunc("/", h.FrontHandler)
+	h.server.Handler = r
+
+	listener, err := net.Listen("tcp", h.server.Addr)
+	if err != nil {
+		return err
+	}
+	h.notifier.Start()
 	go func() {
 		log.Infof("Server launched on port %s", h.config.GetServerPort())
-		err = http.ListenAndServe(":"+h.config.GetServerPort(), r)
-		if err != nil {
-			panic(err.Error())
+		err := h.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Server stopped: %v", err)
 		}
 	}()
+	return nil
+}
 
+// Shutdown stops accepting connections, waits for in-flight requests to
+// complete (or ctx to expire), then stops the stats tracker and makes a last
+// attempt to deliver the queued notifications.
+func (h WebserviceHandler) Shutdown(ctx context.Context) error {
+	log.Info("Shutting down server")
+	err := h.server.Shutdown(ctx)
+	h.stats.Stop()
+	h.notifier.Stop()
+	return err
 }
 
 func (r *router) Get(path string, handler http.Handler) {
-	r.GET(path, wrapHandler(handler))
+	r.GET(path, r.wrapHandler(path, handler))
 }
 
 func (r *router) Post(path string, handler http.Handler) {
-	r.POST(path, wrapHandler(handler))
+	r.POST(path, r.wrapHandler(path, handler))
 }
 
-func NewRouter() *router {
-	return &router{httprouter.New()}
+func NewRouter(m *Metrics) *router {
+	return &router{httprouter.New(), m}
 }
 
-func wrapHandler(h http.Handler) httprouter.Handle {
+// wrapHandler stores the route parameters in the request context and records
+// the request latency under the route pattern.
+func (rt *router) wrapHandler(path string, h http.Handler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		context.Set(r, "params", ps)
-		h.ServeHTTP(w, r)
+		r = r.WithContext(context.WithValue(r.Context(), paramsKey{}, ps))
+		t1 := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		rt.metrics.ObserveRequest(path, r.Method, rec.status, time.Since(t1))
 	}
 }
 
+type paramsKey struct{}
+
+// getParams returns the route parameters stored by wrapHandler.
+func getParams(r *http.Request) httprouter.Params {
+	ps, _ := r.Context().Value(paramsKey{}).(httprouter.Params)
+	return ps
+}
+
 func (handler WebserviceHandler) FrontHandler(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/css") || strings.HasPrefix(r.URL.Path, "/js") ||
 		strings.HasPrefix(r.URL.Path, "/deploy.html") || strings.HasPrefix(r.URL.Path, "/media") ||
@@ -1,25 +1,557 @@
 package web
 
 import (
-	"strconv"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
-	log "github.com/Sirupsen/logrus"
+	. "github.com/beppeben/go-dictionary/domain"
+	"github.com/beppeben/go-dictionary/utils"
 )
 
+type fakeGeolocator map[string]*utils.Location
+
+func (g fakeGeolocator) Locate(ip string) *utils.Location {
+	return g[ip]
+}
+
+type fakeConfig struct {
+	ServerConfig
+	history bool
+}
+
+func (c fakeConfig) GetPrivacyVisitorHistory() bool {
+	return c.history
+}
+
+// fakeRepo implements the repository calls the tests make, any other one
+// panics.
+type fakeRepo struct {
+	Repository
+	audits        []*AuditRecord
+	notifications []*Notification
+	delivered     []int64
+	failed        map[int64]bool
+	counters      []*CounterStat
+	saveErr       error
+	feedback      []*Feedback
+	webTerms      []string
+}
+
+func (repo *fakeRepo) GetLangFromKey(ctx context.Context, key string) string {
+	return map[string]string{"eng": "english", "ita": "italian"}[key]
+}
+
+func (repo *fakeRepo) GetOpenFeedback(ctx context.Context, lang string, conceptId int64) ([]*Feedback, error) {
+	return repo.feedback, nil
+}
+
+func (repo *fakeRepo) UpdateWebTerm(ctx context.Context, lang, key, value string) error {
+	repo.webTerms = append(repo.webTerms, lang+key)
+	return nil
+}
+
+func (repo *fakeRepo) AddAuditRecord(ctx context.Context, record *AuditRecord) error {
+	repo.audits = append(repo.audits, record)
+	return nil
+}
+
+func (repo *fakeRepo) SaveStats(ctx context.Context, searches []*SearchStat, visits []*VisitStat, counters []*CounterStat) error {
+	if repo.saveErr != nil {
+		return repo.saveErr
+	}
+	repo.counters = append(repo.counters, counters...)
+	return nil
+}
+
+func (repo *fakeRepo) GetDueNotifications(ctx context.Context, limit int) ([]*Notification, error) {
+	return repo.notifications, nil
+}
+
+func (repo *fakeRepo) MarkNotificationDelivered(ctx context.Context, id int64) error {
+	repo.delivered = append(repo.delivered, id)
+	return nil
+}
+
+// MarkNotificationFailed records whether the notification was given up on.
+func (repo *fakeRepo) MarkNotificationFailed(ctx context.Context, id int64, lastError string, next time.Time, giveUp bool) error {
+	repo.failed[id] = giveUp
+	return nil
+}
+
+// fakeMessages fails to send on the channels mapped to true.
+type fakeMessages map[string]bool
+
+func (m fakeMessages) HasChannel(channel string) bool {
+	_, ok := m[channel]
+	return ok
+}
+
+func (m fakeMessages) Send(channel string, msg *utils.Message) error {
+	if m[channel] {
+		return errors.New(channel + " is down")
+	}
+	return nil
+}
+
 func TestStats(t *testing.T) {
+	geo := fakeGeolocator{"89.3.117.15": {City: "Paris", Country: "FR"}}
+	ips, _ := utils.NewIPAnonymizer(utils.IPTruncate)
+	stats := &StatsTracker{keyToUser: make(map[string]*User), geo: geo, ips: ips,
+		config: fakeConfig{history: true}}
+
+	stats.NotifyUser(&User{Ip: "89.3.117.15", UserAgent: "test", LastUri: "/"})
+	stats.NotifyUser(&User{Ip: "89.3.117.15", UserAgent: "test", LastUri: "/about.html"})
+
+	if len(stats.keyToUser) != 1 {
+		t.Fatalf("expected one visitor, got %d", len(stats.keyToUser))
+	}
+	for _, user := range stats.keyToUser {
+		if user.City != "Paris" || user.Country != "FR" {
+			t.Errorf("visitor not located: %q, %q", user.City, user.Country)
+		}
+		if user.Counter != 2 || user.LastUri != "/about.html" {
+			t.Errorf("expected 2 hits ending on /about.html, got %d ending on %s", user.Counter, user.LastUri)
+		}
+		if user.Ip != "89.3.117.0" {
+			t.Errorf("address not anonymized: %s", user.Ip)
+		}
+	}
+
+	stats = &StatsTracker{keyToUser: make(map[string]*User), geo: geo, ips: ips, config: fakeConfig{}}
+	stats.NotifyUser(&User{Ip: "89.3.117.15", UserAgent: "test", Referer: "http://example.com", LastUri: "/"})
+	for _, user := range stats.keyToUser {
+		if user.LastUri != "" || user.Referer != "" {
+			t.Errorf("history kept while disabled: %s, %s", user.LastUri, user.Referer)
+		}
+	}
+}
+
+func TestBotClassifier(t *testing.T) {
+	bots := NewBotClassifier([]string{"MyMonitor"}, 3)
+	request := func(path, agent string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("User-Agent", agent)
+		r.Header.Set("Accept", "text/html")
+		r.Header.Set("Accept-Language", "en")
+		return r
+	}
+	browser := "Mozilla/5.0 (X11; Linux x86_64) Firefox/115.0"
+
+	for agent, want := range map[string]string{
+		"": botNoAgent,
+		"Mozilla/5.0 (compatible; Googlebot/2.1)": "googlebot",
+		"mymonitor/1.0": "mymonitor",
+		"curl/8.0":      "curl",
+		browser:         "",
+	} {
+		if got := bots.Classify(request("/", agent), "1.2.3.4"+agent); got != want {
+			t.Errorf("%q classified as %q, expected %q", agent, got, want)
+		}
+	}
+
+	r := request("/", browser)
+	r.Header.Del("Accept-Language")
+	if got := bots.Classify(r, "headless"); got != botNoHeaders {
+		t.Errorf("request without headers classified as %q", got)
+	}
+
+	bots.Classify(request("/robots.txt", browser), "robots")
+	if got := bots.Classify(request("/", browser), "robots"); got != botRobots {
+		t.Errorf("robots.txt fetcher classified as %q", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := bots.Classify(request("/", browser), "fast"); got != "" {
+			t.Fatalf("request %d classified as %q", i, got)
+		}
+	}
+	if got := bots.Classify(request("/", browser), "fast"); got != botRate {
+		t.Errorf("fast client classified as %q", got)
+	}
+
+	// autocompletions do not count towards the rate
+	for i := 0; i < 5; i++ {
+		if got := bots.Known(request("/services/autocomplete/engita", browser), "typing"); got != "" {
+			t.Fatalf("autocompletion %d classified as %q", i, got)
+		}
+	}
+	if got := bots.Classify(request("/", browser), "typing"); got != "" {
+		t.Errorf("typing client classified as %q", got)
+	}
+	if got := bots.Known(request("/services/autocomplete/engita", browser), "robots"); got != botRobots {
+		t.Errorf("robots.txt fetcher autocompleting classified as %q", got)
+	}
+}
 
-	user := &User{Ip: "89.3.117.15", Counter: 10}
+func TestReportSchedules(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, rome)
+	reports, err := parseReportSchedules([]utils.ReportSchedule{
+		{Period: "weekly", Weekday: "monday", At: "08:00", Timezone: "Europe/Rome", Channel: "email", Format: "html"},
+		{Period: "monthly", At: "08:00", Timezone: "Europe/Rome", Channel: "slack"},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(s string) time.Time {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.Local)
+		return d
+	}
+	for i, want := range []struct {
+		next     time.Time
+		from, to time.Time
+	}{
+		{time.Date(2026, 10, 26, 8, 0, 0, 0, rome), day("2026-10-19"), day("2026-10-25")},
+		{time.Date(2026, 11, 1, 8, 0, 0, 0, rome), day("2026-10-01"), day("2026-10-31")},
+	} {
+		if !reports[i].next.Equal(want.next) {
+			t.Errorf("%s report due %v, expected %v", reports[i].Period, reports[i].next, want.next)
+		}
+		if from, to := reports[i].period(reports[i].next); !from.Equal(want.from) || !to.Equal(want.to) {
+			t.Errorf("%s report covers %v to %v", reports[i].Period, from, to)
+		}
+	}
+	if reports[0].Name != "Weekly report" {
+		t.Errorf("unexpected default name %q", reports[0].Name)
+	}
+
+	if _, err := parseReportSchedules([]utils.ReportSchedule{{Period: "daily", At: "16:00", Channel: "slack",
+		Format: "html"}}, now); err == nil {
+		t.Error("html report accepted on slack")
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	text := strings.Repeat("a", 30) + "\n\n" + strings.Repeat("b", 30) + "\n\n" + strings.Repeat("è", 40)
+	parts := splitText(text, 64)
+	if len(parts) != 3 {
+		t.Fatalf("unexpected parts %q", parts)
+	}
+	for _, p := range parts {
+		if len(p) > 64 || !utf8.ValidString(p) {
+			t.Errorf("invalid part %q", p)
+		}
+	}
+	if parts[0] != strings.Repeat("a", 30)+"\n\n"+strings.Repeat("b", 30) {
+		t.Errorf("paragraphs not kept together: %q", parts[0])
+	}
+}
+
+func TestEventsFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/events?from=2026-10-01&to=2026-10-31&tag=Fairs&q=+gems+", nil)
+	filter, err := getEventsFilter(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.From.Format("2006-01-02") != "2026-10-01" || filter.To.Format("2006-01-02") != "2026-10-31" ||
+		filter.Tag != "Fairs" || filter.Query != "gems" {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/events?from=2026-10-01", nil)
+	if filter, err = getEventsFilter(r); err != nil || filter.To.Format("2006-01-02") != "2026-12-29" {
+		t.Errorf("unexpected default end %v (%v)", filter.To, err)
+	}
+
+	for _, invalid := range []string{"from=2026-10-32", "from=2026-10-01&to=2026-09-30", "from=2026-01-01&to=2028-01-05",
+		"from=0001-01-01&to=0001-01-31", "from=9999-12-01&to=9999-12-31", "from=2026-01-01&to=9999-12-31"} {
+		if _, err := getEventsFilter(httptest.NewRequest("GET", "/api/v1/events?"+invalid, nil)); err == nil {
+			t.Errorf("%s accepted", invalid)
+		}
+	}
+
+	offset, limit := getPage(httptest.NewRequest("GET", "/api/v1/events?offset=-3&limit=5000", nil))
+	if offset != 0 || limit != defaultEvents {
+		t.Errorf("unexpected page %d, %d", offset, limit)
+	}
+}
+
+func TestCalendarLayout(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	// October 2026 is laid out from Monday 28 September, over five weeks
+	first := day("2026-09-28")
+	events := []*CalendarEvent{
+		{Tag: "across", StartDate: day("2026-09-20"), EndDate: day("2026-10-06")},
+		{Tag: "beyond", StartDate: day("2026-10-30"), EndDate: day("2026-11-05")},
+	}
+	for i := 0; i < 60; i++ {
+		events = append(events, &CalendarEvent{Tag: "busy", StartDate: day("2026-10-14"), EndDate: day("2026-10-14")})
+	}
+	placed := layoutEvents(events, first, 5)
+	if len(placed) != 63 {
+		t.Fatalf("%d pieces placed", len(placed))
+	}
+	// the first event starts before the grid and runs into the second week
+	if p := placed[0]; p.Row != 2 || p.Column != 1 || p.Span != 7 || !p.IsContinuation {
+		t.Errorf("unexpected first piece %+v", p)
+	}
+	if p := placed[1]; p.Row != 3 || p.Column != 1 || p.Span != 2 || !p.IsContinuation || p.Level != 0 {
+		t.Errorf("unexpected second piece %+v", p)
+	}
+	// the second one is cut at the end of the grid
+	if p := placed[2]; p.Row != 6 || p.Column != 5 || p.Span != 3 || p.IsContinuation {
+		t.Errorf("unexpected last piece %+v", p)
+	}
+	for i, p := range placed[3:] {
+		if p.Row != 4 || p.Column != 3 || p.Span != 1 || p.Level != i {
+			t.Errorf("busy event %d placed at %+v", i, p)
+		}
+	}
+	if len(layoutEvents(events[:1], day("2026-10-12"), 1)) != 0 {
+		t.Error("event placed outside of the grid")
+	}
+}
+
+func TestWriteAudit(t *testing.T) {
+	tests := []struct {
+		auth    string
+		status  int
+		err     string
+		outcome string
+	}{
+		{"Bearer x", http.StatusOK, "", AuditOK},
+		{"Bearer x", http.StatusOK, "cannot read file", AuditError},
+		{"Bearer x", http.StatusBadRequest, "", AuditError},
+		{"Bearer x", http.StatusUnauthorized, "", AuditDenied},
+		{"Basic x", http.StatusForbidden, "", AuditDenied},
+		{"", http.StatusForbidden, "", AuditDenied},
+		// anonymous requests are not recorded
+		{"", http.StatusUnauthorized, "", ""},
+	}
+	for _, test := range tests {
+		repo := &fakeRepo{}
+		handler := WebserviceHandler{repo: repo}
+		r := httptest.NewRequest("POST", "/admin/deploy", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		handler.writeAudit(r, &AuditRecord{Action: "deploy-db", Error: test.err}, test.status)
+		if test.outcome == "" {
+			if len(repo.audits) != 0 {
+				t.Errorf("%q %d: recorded as %s", test.auth, test.status, repo.audits[0].Outcome)
+			}
+			continue
+		}
+		if len(repo.audits) != 1 || repo.audits[0].Outcome != test.outcome {
+			t.Errorf("%q %d %q: expected one %s record, got %v", test.auth, test.status, test.err, test.outcome, repo.audits)
+		}
+	}
+}
+
+func TestNotificationBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{5, 32 * time.Minute},
+		{8, 256 * time.Minute},
+		{9, notificationMaxBackoff},
+		{20, notificationMaxBackoff},
+		{100, notificationMaxBackoff},
+	}
+	for _, test := range tests {
+		if backoff := notificationBackoff(test.attempts); backoff != test.backoff {
+			t.Errorf("after %d attempts: expected %s, got %s", test.attempts, test.backoff, backoff)
+		}
+	}
+}
 
-	/*
-		user, err := getUserFromIp("89.3.117.15")
+func TestDeliverDue(t *testing.T) {
+	repo := &fakeRepo{failed: make(map[int64]bool), notifications: []*Notification{
+		{Id: 1, Channel: "email"},
+		{Id: 2, Channel: "slack"},
+		{Id: 3, Channel: "slack", Attempts: notificationMaxAttempts - 1},
+	}}
+	q := NewNotificationQueue(repo, fakeMessages{"email": false, "slack": true}, fakeConfig{})
+	q.deliverDue()
 
-		if err != nil {
-			log.Println(err.Error())
+	if len(repo.delivered) != 1 || repo.delivered[0] != 1 {
+		t.Errorf("expected notification 1 delivered, got %v", repo.delivered)
+	}
+	if giveUp, ok := repo.failed[2]; !ok || giveUp {
+		t.Errorf("expected notification 2 to be retried")
+	}
+	if !repo.failed[3] {
+		t.Errorf("expected notification 3 to be given up on")
+	}
+}
+
+func TestStatsFlush(t *testing.T) {
+	repo := &fakeRepo{saveErr: errors.New("value too long")}
+	stats := &StatsTracker{repo: repo, keyToUser: make(map[string]*User), searches: make(map[searchKey]int),
+		counters: make(map[counterKey]int)}
+	stats.NotifyCounter(counterReferer, strings.Repeat("é", 300)+".com")
+	for i := 0; i < statsMaxRetries; i++ {
+		stats.flush()
+		if len(stats.counters) != 1 {
+			t.Fatalf("flush %d: expected the counter to be kept, got %d", i+1, len(stats.counters))
+		}
+	}
+	stats.flush()
+	if len(stats.counters) != 0 {
+		t.Errorf("expected the counter to be dropped after %d retries", statsMaxRetries)
+	}
+
+	repo.saveErr = nil
+	stats.NotifyCounter(counterReferer, strings.Repeat("é", 300)+".com")
+	stats.flush()
+	if len(repo.counters) != 1 || utf8.RuneCountInString(repo.counters[0].Key) != statsKeyLength {
+		t.Errorf("expected one key of %d characters, got %v", statsKeyLength, repo.counters)
+	}
+}
+
+func TestStatsCleanText(t *testing.T) {
+	stats := &StatsTracker{keyToUser: make(map[string]*User), searches: make(map[searchKey]int),
+		counters: make(map[counterKey]int), geo: fakeGeolocator{}, config: fakeConfig{history: true}}
+	stats.ips, _ = utils.NewIPAnonymizer(utils.IPTruncate)
+	stats.NotifySearch("itaeng", "ca\x00sa\xff", true)
+	stats.NotifyUser(&User{Ip: "89.3.117.15", UserAgent: "test\x00", Referer: "http://example.com/\xc3", LastUri: "/"})
+
+	for k := range stats.searches {
+		if k.term != "casa" {
+			t.Errorf("expected term casa, got %q", k.term)
+		}
+	}
+	for _, user := range stats.keyToUser {
+		if user.UserAgent != "test" || user.Referer != "http://example.com/" {
+			t.Errorf("headers not cleaned: %q, %q", user.UserAgent, user.Referer)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		realIP string
+		remote string
+		ip     string
+	}{
+		{"89.3.117.15", "10.0.0.1:4242", "89.3.117.15"},
+		{"89.3.117.15:4242", "10.0.0.1:4242", "89.3.117.15"},
+		{"2001:db8::1", "10.0.0.1:4242", "2001:db8::1"},
+		{"[2001:db8::1]:4242", "10.0.0.1:4242", "2001:db8::1"},
+		{"", "[2001:db8::2]:4242", "2001:db8::2"},
+		{"", "10.0.0.1:4242", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if ip := clientIP(r); ip != test.ip {
+			t.Errorf("%q from %q: expected %s, got %s", test.realIP, test.remote, test.ip, ip)
 		}
-	*/
-	user.getLocation()
+	}
+}
+
+func TestPrincipalCan(t *testing.T) {
+	tests := []struct {
+		principal *Principal
+		perm      Permission
+		can       bool
+	}{
+		{&Principal{Role: RoleViewer}, PermReadStats, true},
+		{&Principal{Role: RoleViewer}, PermEditWeb, false},
+		{&Principal{Role: RoleEditor}, PermEditEntries, true},
+		{&Principal{Role: RoleEditor}, PermDeployDb, false},
+		{&Principal{Role: RoleAdmin}, PermManageTokens, true},
+		{&Principal{Role: Role("owner")}, PermReadStats, false},
+		// tokens only have their own permissions, whatever the role
+		{&Principal{Role: RoleAdmin, Permissions: []Permission{PermDeployDb}}, PermDeployDb, true},
+		{&Principal{Role: RoleAdmin, Permissions: []Permission{PermDeployDb}}, PermDeployCal, false},
+		{&Principal{Role: RoleAdmin, Permissions: []Permission{}}, PermReadStats, false},
+	}
+	for _, test := range tests {
+		if can := test.principal.Can(test.perm); can != test.can {
+			t.Errorf("%s %v can %s: expected %v", test.principal.Role, test.principal.Permissions, test.perm, test.can)
+		}
+	}
+}
+
+func TestApiTokenValid(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		token *ApiToken
+		valid bool
+	}{
+		{&ApiToken{Expires: now.Add(time.Hour)}, true},
+		{&ApiToken{Expires: now.Add(time.Hour), Revoked: true}, false},
+		{&ApiToken{Expires: now}, false},
+		{&ApiToken{Expires: now.Add(-time.Hour)}, false},
+		// the same instant in another time zone
+		{&ApiToken{Expires: now.In(time.FixedZone("CEST", 2*3600)).Add(time.Minute)}, true},
+	}
+	for i, test := range tests {
+		if valid := test.token.Valid(now); valid != test.valid {
+			t.Errorf("token %d: expected valid %v", i, test.valid)
+		}
+	}
+}
+
+func TestStatsPeriod(t *testing.T) {
+	tests := []struct {
+		query    string
+		from, to string
+	}{
+		{"from=2026-09-01&to=2026-09-30", "2026-09-01", "2026-09-30"},
+		{"to=2026-09-30", "2026-09-01", "2026-09-30"},
+		{"from=2026-09-01&to=2026-9-30", "", ""},
+		{"from=yesterday", "", ""},
+	}
+	for _, test := range tests {
+		from, to, err := getStatsPeriod(httptest.NewRequest("GET", "/admin/stats/top?"+test.query, nil))
+		if test.from == "" {
+			if err == nil {
+				t.Errorf("%s: accepted", test.query)
+			}
+			continue
+		}
+		if err != nil || from.Format("2006-01-02") != test.from || to.Format("2006-01-02") != test.to {
+			t.Errorf("%s: expected %s to %s, got %s to %s (%v)", test.query, test.from, test.to,
+				from.Format("2006-01-02"), to.Format("2006-01-02"), err)
+		}
+	}
+}
 
-	log.Println(user.City + " - " + strconv.FormatInt(user.Counter, 10))
+func TestFeedbackJSON(t *testing.T) {
+	repo := &fakeRepo{feedback: []*Feedback{{Id: 1, ConceptId: 7, Lang: "italian", Word: "casa",
+		Category: "typo", Ip: "89.3.117.0"}}}
+	handler := WebserviceHandler{repo: repo}
+	w := httptest.NewRecorder()
+	handler.FeedbackJSON(w, httptest.NewRequest("GET", "/services/feedback?lang=ita&id=7", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "casa") {
+		t.Fatalf("unexpected answer %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "89.3.117") {
+		t.Errorf("reporter address served: %s", w.Body.String())
+	}
+}
 
+func TestUpdateWebString(t *testing.T) {
+	repo := &fakeRepo{}
+	handler := WebserviceHandler{repo: repo}
+	w := httptest.NewRecorder()
+	handler.UpdateWebString(w, httptest.NewRequest("POST", "/services/webString?lang=xyz&key=title&value=a", nil))
+	if w.Code != http.StatusBadRequest || len(repo.webTerms) != 0 {
+		t.Errorf("unknown language accepted: %d %v", w.Code, repo.webTerms)
+	}
+	w = httptest.NewRecorder()
+	handler.UpdateWebString(w, httptest.NewRequest("POST", "/services/webString?lang=ita&key=title&value=a", nil))
+	if w.Body.String() != "OK" || len(repo.webTerms) != 1 || repo.webTerms[0] != "italiantitle" {
+		t.Errorf("unexpected answer %s: %v", w.Body.String(), repo.webTerms)
+	}
 }